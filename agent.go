@@ -3,14 +3,19 @@ package bearer
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
 	"net"
 	"net/http"
+	"net/url"
+	"reflect"
 	"regexp"
-	"runtime"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -29,25 +34,393 @@ type Agent struct {
 	// Required
 	SecretKey string
 
-	// If set, the RoundTripper interface actually used to make requests
+	// If set, the next RoundTripper in the chain, actually used to make requests.
+	// This allows inserting the agent in an existing chain of RoundTrippers (see Wrap).
+	// The agent's own requests to Bearer do not go through it.
 	// If nil, an equivalent of http.DefaultTransport is used
 	Transport http.RoundTripper
 
+	// If set, the RoundTripper used for the agent's own requests to Bearer (config fetching and records delivery),
+	// i.e., with a custom TLS configuration, or a fake Bearer in tests. The Operational options below are then ignored.
+	// If nil, a dedicated transport is used, even if Transport is set.
+	OperationalTransport http.RoundTripper
+
+	// If set, the maximum number of idle connections kept for the agent's own requests to Bearer.
+	// If zero, 2 is used, which is enough for periodic requests to a single host.
+	OperationalMaxIdleConns int
+
+	// If set, how long idle connections to Bearer are kept.
+	// If zero, 30s is used.
+	OperationalIdleConnTimeout time.Duration
+
+	// If set, returns the proxy used for the agent's own requests to Bearer, even if Transport is set.
+	// This allows sending Bearer traffic through a dedicated egress proxy, i.e., http.ProxyURL(proxyURL).
+	// If nil, http.ProxyFromEnvironment is used.
+	OperationalProxy func(req *http.Request) (*url.URL, error)
+
+	// If set, is added to the User-Agent of the agent's own requests to Bearer,
+	// i.e., "bearer-go/1.2.0 (billing)", to identify them in egress logs.
+	ServiceName string
+
+	// If true, the agent is a pure pass-through to Transport:
+	// no config fetching, no recording, no goroutines.
+	Disabled bool
+
+	// If true, requests are never blocked, and the config is not fetched to enforce BlockedDomains.
+	DisableBlocking bool
+
 	// If set, will be used for internal logging.
 	Logger *zap.Logger
 
+	// If set and Logger is nil, will be used for internal logging.
+	// This allows using a *slog.Logger, or any other leveled logger.
+	LeveledLogger LeveledLogger
+
 	// If set, this context will be used by the agent for managing its internal goroutines
-	// and performing operational requests.
+	// and performing operational requests. Once it is done, pending deliveries are abandoned.
 	Context context.Context
 
+	// If set, is used as the config until the first refresh,
+	// which avoids fetching the config when the first request is made.
+	InitialConfig *Config
+
 	// Duration between two config refreshes.
 	// If empty, will use 5s as default.
 	RefreshConfigEvery time.Duration
 
+	// If set, will be used to timestamp records.
+	// If nil, the system clock is used.
+	Clock Clock
+
+	// If set, ascending latency thresholds used to classify records in coarse buckets,
+	// i.e., with 100ms and 1s, the LatencyBucket of records is "0s-100ms", "100ms-1s" or "1s+".
+	LatencyThresholds []time.Duration
+
+	// If set, will be used to redact records before sending them to Bearer.
+	// If nil, the built-in regex-based sanitizer is used.
+	Sanitizer Sanitizer
+
+	// If not empty, only these request headers (case-insensitive) are captured.
+	// If empty, all the request headers are captured.
+	CaptureRequestHeaders []string
+
+	// If not empty, only these response headers (case-insensitive) are captured.
+	// If empty, all the response headers are captured.
+	CaptureResponseHeaders []string
+
+	// If set, the maximum number of request headers and of response headers captured.
+	// Headers are kept in alphabetical order, and the number of dropped ones is recorded.
+	// If zero, all the headers are captured.
+	MaxHeaders int
+
+	// Headers whose value is recorded as the RequestID of records, checked in order
+	// on the response, then on the request.
+	// If empty, X-Request-Id and X-Amzn-RequestId are used.
+	RequestIDHeaders []string
+
+	// Headers (case-insensitive) that are never captured, not even as a redacted value.
+	DropHeaders []string
+
+	// If true, records only contain the metadata of requests (method, URL without query, status, timing),
+	// and no headers, query parameters or bodies. The path and the tags are still sanitized.
+	MetadataOnly bool
+
+	// If true, the query string is removed from the recorded URLs, and QueryParams are not recorded.
+	StripQueryParams bool
+
+	// If true, records are logged (at Info level) instead of being sent to Bearer.
+	// This allows checking what would be sent, i.e., that nothing sensitive leaks.
+	DryRun bool
+
+	// If true, the whitespace of JSON request and response bodies is removed after sanitization,
+	// which reduces the size of records.
+	CompactJSONBodies bool
+
+	// Maximum duration Flush waits for the pending records to be delivered.
+	// If empty, will use 5s as default.
+	FlushTimeout time.Duration
+
+	// If set, the recorded request and response bodies are truncated to this number of bytes,
+	// after sanitization. The original sizes are set on the record, and counted in Stats.TruncatedBodies.
+	// If zero, bodies are not truncated. It can be overridden per request with ContextWithMaxBodySize.
+	MaxBodySize int
+
+	// If true, a warning is logged whenever a body is truncated to MaxBodySize.
+	WarnOnTruncatedBodies bool
+
+	// If set, response bodies larger than this number of bytes (as received, i.e., compressed)
+	// are not captured, and ResponseBodySkipped is set on the record. Their Content-Length is checked
+	// before reading them, so that huge bodies are not buffered just to be discarded. Without Content-Length,
+	// the body is buffered up to this size, and is then streamed to the application without being captured.
+	// If zero, response bodies are captured whatever their size.
+	MaxCapturedResponseSize int
+
+	// If true, bodies containing invalid UTF-8 or NUL bytes are encoded in base64,
+	// so they are delivered intact, and the RequestBodyEncoding or ResponseBodyEncoding
+	// of the record is set to "base64". Other bodies are kept as raw strings.
+	EncodeBinaryBodies bool
+
+	// If true, the request and response bodies are replaced by their SHA-256 digest, i.e., "sha256:<hex>",
+	// and BodiesHashed is set on the record. This allows comparing bodies without recording their content.
+	// The digest is computed on the captured body, before sanitization.
+	HashBodies bool
+
+	// If true, the buffers used to read and decompress bodies are reused across requests,
+	// which reduces allocations (and GC pressure) under high throughput.
+	// The bodies kept by requests, responses and records are always copied out of the reused buffers.
+	PoolBuffers bool
+
+	// If set, records are appended to a spool file (JSON lines) in this directory before their delivery,
+	// and removed once delivered. When the agent starts, the records left undelivered by a previous process,
+	// i.e., which died before flushing them, are delivered. The directory should not be shared
+	// by concurrent processes, or their records may be delivered twice.
+	SpoolDir string
+
+	// If true, RoundTrip does none of the agent's work before returning the result of the transport,
+	// so that a panic or a slowness of the agent can not affect the application's requests:
+	// the bodies are copied while they are read, and requests are recorded in the background,
+	// once the response body has been fully read or closed (requests whose body is never closed are not recorded).
+	// Only the bodies of parseable content types are copied, up to MaxCapturedResponseSize or a bit more
+	// than MaxBodySize, and upgraded connections are returned untouched.
+	// Blocked domains are still blocked. CaptureRedirects and CaptureTimings are ignored in this mode,
+	// and CaptureTrailers only applies to the copied bodies which are read to the end, as the other requests
+	// are recorded without waiting for their trailers. For the same reason, the gRPC status of the trailers
+	// is not recorded, nor the size of the chunked response bodies which are not copied.
+	SafeMode bool
+
+	// If true, records are delivered before RoundTrip returns, instead of in the background.
+	// This guarantees delivery for short-lived programs, at the cost of latency.
+	SynchronousDelivery bool
+
+	// If true, the "file:line" of the application code which made the request is recorded.
+	// It has a cost for every request, so it should only be used for debugging.
+	CaptureCallSite bool
+
+	// If true, the requests of a chain of redirects followed by an http.Client are linked:
+	// their records share a RedirectID, and have a RedirectHop starting at 1.
+	CaptureRedirects bool
+
+	// If true, the response trailers are recorded, and sanitized like headers.
+	// As trailers are only received after the body, records of responses announcing trailers
+	// are delivered once the body has been read or closed by the application.
+	CaptureTrailers bool
+
+	// If true, the request headers sent by Transport are also recorded as OutboundRequestHeaders,
+	// including those added by the RoundTrippers wrapped by the agent, i.e., an authentication middleware.
+	// RequestHeaders are always the headers of the request received by the agent. The outbound headers
+	// are those of the Request of the response, so they are only recorded if the transport sets it,
+	// as http.Transport does.
+	CaptureOutboundRequestHeaders bool
+
+	// If set, a correlation ID is generated for each request, recorded, and sent in this header,
+	// i.e., "X-Correlation-Id", so that the server can record it too. If the request already has this header,
+	// its value is used as the correlation ID instead of a generated one. If not set, no correlation ID is recorded.
+	CorrelationIDHeader string
+
+	// If true, the local and remote addresses of the connection are recorded.
+	CaptureAddrs bool
+
+	// If true, the time to the first byte of the response, and the time to read the response body
+	// (from the response headers until the body has been fully read or closed) are recorded, in milliseconds.
+	// Records of responses whose body is not read by the agent are delivered once it has been read or closed
+	// by the application.
+	CaptureTimings bool
+
+	// If true, the IP addresses the hostname resolved to are recorded, or the DNS error.
+	// They are empty when the connection is reused, as no DNS lookup is performed.
+	CaptureDNS bool
+
+	// If set, the maximum number of deliveries to Bearer per second.
+	// When exceeded, records accumulate in the buffer (see BufferLen) instead of triggering more requests.
+	MaxDeliveriesPerSecond float64
+
+	// If set, the number of consecutive failed deliveries to Bearer (network errors and 5xx responses)
+	// after which the deliveries are suspended for CircuitBreakerCooldown: records are not sent to Bearer
+	// meanwhile, and fail with ErrCircuitOpen (they are kept in the spool, if SpoolDir is set).
+	// After the cooldown, a single delivery tests the recovery: it closes the circuit if it succeeds,
+	// or suspends the deliveries again. The state of the circuit is in Stats.CircuitState.
+	// If zero, deliveries are always attempted.
+	CircuitBreakerThreshold int
+
+	// Duration the deliveries are suspended once the circuit breaker opens.
+	// If empty, will use 30s as default.
+	CircuitBreakerCooldown time.Duration
+
+	// If true, request and response bodies are only captured for failed requests
+	// (status code >= 400 or transport error).
+	CaptureBodiesOnErrorOnly bool
+
+	// If true, the built-in sanitizer keeps the scheme of Authorization headers ("Bearer [FILTERED]"),
+	// and the non-sensitive header claims of JWT bearer tokens (alg, kid, typ).
+	// By default, Authorization headers are entirely redacted.
+	PartialAuthorizationRedaction bool
+
+	// If true, identical records (same method, hostname, path and status code) delivered
+	// in the same batch, i.e., buffered during the same flush interval, are collapsed into a single record with a Count.
+	DeduplicateBatch bool
+
+	// If set, the maximum size in bytes of the requests delivering records to Bearer.
+	// A batch is delivered as soon as its records add up to this size, independently of their number,
+	// and larger batches are split, so that they are not rejected by Bearer's API.
+	MaxBatchBytes int
+
+	// If true, a record larger than MaxBatchBytes on its own is dropped, with a warning.
+	// By default, its bodies are truncated until it fits. Both are counted in Stats.OversizedRecords.
+	DropOversizedRecords bool
+
+	// If set, tags added to every record, i.e., the service name, environment or region.
+	// Only the values of the tags whose names are sensitive keys are redacted.
+	StaticTags map[string]string
+
+	// If set, records are also delivered to these sinks, in addition to Bearer.
+	// A sink failing to receive records does not prevent the delivery to the others.
+	Sinks []RecordSink
+
+	// If set, is used to encode the batches of records delivered to Bearer.
+	// If nil, JSONMarshaler is used.
+	Marshaler Marshaler
+
+	// If set, the version of the schema of the logs requests, i.e., SchemaVersion1,
+	// for deployments of Bearer which do not support the latest one.
+	// If zero, DefaultSchemaVersion is used.
+	SchemaVersion int
+
+	// If set, is called after each delivery with its duration and error (if any),
+	// i.e., to feed a histogram of delivery durations.
+	DeliveryObserver func(duration time.Duration, err error)
+
+	// If set, is called after each delivery attempt with the delivered records and its error (if any),
+	// i.e., to track the time of the last successful delivery. A panic in it is recovered.
+	AfterDelivery func(records []ReportLog, err error)
+
+	// If set, is called with each sanitized record before delivery.
+	// The record can be modified (i.e., to add Tags), or dropped by returning false.
+	ProcessRecord func(record *ReportLog) bool
+
+	// If true, the built-in sanitizer redacts Basic auth credentials ("Basic dXNlcjpwYXNz")
+	// found in bodies, query parameters and header values, not only in Authorization headers.
+	RedactBasicCredentials bool
+
+	// If true, the built-in sanitizer redacts card numbers: runs of 13 to 19 digits,
+	// possibly separated by spaces or dashes, which pass the Luhn checksum.
+	// Other numbers, i.e., most numeric IDs and timestamps, are kept.
+	RedactLuhnCardNumbers bool
+
+	// If true, the built-in sanitizer redacts IBANs passing the mod-97 checksum,
+	// i.e., "GB82 WEST 1234 5698 7654 32".
+	RedactIBANs bool
+
+	// If true, the built-in sanitizer redacts SWIFT/BIC codes, i.e., "DEUTDEFF500".
+	// As any 8 or 11 uppercase letters and digits look like a BIC, this may redact other codes.
+	RedactBICs bool
+
+	// If true, the built-in sanitizer redacts phone numbers in the formats of PhoneNumberRegions.
+	RedactPhoneNumbers bool
+
+	// Formats of the phone numbers redacted by RedactPhoneNumbers: "E164" (international, i.e., "+33 6 12 34 56 78"),
+	// "US", "FR" or "GB". National formats only match numbers written with separators, i.e., "(415) 555-2671".
+	// If empty, all of them are used. Unknown formats are ignored.
+	PhoneNumberRegions []string
+
+	// If set, the built-in sanitizer redacts the values of the headers, query parameters,
+	// JSON keys and cookies whose names match this regex, instead of the default ones.
+	SensitiveKeys *regexp.Regexp
+
+	// If set, the built-in sanitizer also redacts the values of the keys of these profiles,
+	// i.e., AWSSensitiveKeys.
+	SensitiveKeyProfiles []SensitiveKeyProfile
+
+	// If set, the built-in sanitizer redacts the values of these headers (case-insensitive) with their rule
+	// instead of the other rules, i.e., {"X-Api-Key": bearer.KeepPrefix(4)} to identify the key used.
+	// The values of the other sensitive headers are still entirely redacted.
+	HeaderRules map[string]HeaderRule
+
+	// If set, the built-in sanitizer also redacts the keys and values of these RedactionProfiles:
+	// "pci", "gdpr", "aws" or "gcp". Their patterns are combined, and unknown names are ignored.
+	Profiles []string
+
+	// If set, the built-in sanitizer redacts the values matching this regex (wherever they appear),
+	// instead of the default ones (emails and card numbers).
+	// Use NoSensitiveValues to only redact the values of sensitive keys.
+	SensitiveValues *regexp.Regexp
+
+	// If set, the built-in sanitizer redacts every occurrence of these literal strings,
+	// i.e., a known token, in headers, query parameters, URLs and bodies.
+	SecretStrings []string
+
+	// If set, the built-in sanitizer redacts the values at these paths of JSON bodies,
+	// whatever their key. Paths are dotted, i.e., "data.user.ssn" or "$.data.user.ssn",
+	// and the elements of an array have the path of the array.
+	RedactJSONPaths []string
+
+	// If true, the built-in sanitizer redacts the values of all cookies.
+	// By default, only cookies with a sensitive name (session, token, etc.) are redacted.
+	RedactAllCookies bool
+
+	// If set, the fraction of requests that are recorded, between 0 and 1.
+	// If zero, all the requests are recorded.
+	SampleRate float64
+
+	// If set, overrides the agent-wide settings for the requests to some hosts.
+	// Keys are hostnames ("api.example.com") or wildcard patterns ("*.example.com").
+	Hosts map[string]HostSettings
+
+	// If set, the maximum duration of the requests whose context has no deadline, including reading
+	// the response body, so that a hanging server can not block the application forever.
+	// An existing deadline is never overridden. The requests which time out fail with context.DeadlineExceeded,
+	// and are only recorded if RecordCancellations is set. If zero, requests are not limited.
+	DefaultRequestTimeout time.Duration
+
+	// If true, requests cancelled by their context (context.Canceled or context.DeadlineExceeded)
+	// are recorded, with the RequestCancelled type. By default, they are not recorded.
+	RecordCancellations bool
+
+	// If set, the requests whose path matches one of these patterns are not recorded, i.e., health checks.
+	// Patterns containing "*", "?" or "[" are globs, as in path.Match ("/api/*/status"),
+	// others are prefixes matching whole segments ("/healthz" matches "/healthz/ready", not "/healthzz").
+	ExcludePaths []string
+
+	// If set, the requests whose path matches one of these patterns are handled as GraphQL requests,
+	// even if their body has no "variables" nor "operationName". Patterns are the same as ExcludePaths.
+	// In any case, the inline string arguments of GraphQL queries are redacted if their name is sensitive,
+	// i.e., login(password: "secret"), and so are variables sent as an encoded JSON string.
+	GraphQLPaths []string
+
+	// If true, the operation name of GraphQL requests is recorded, from their "operationName"
+	// or from their query, i.e., "query GetUser { ... }".
+	CaptureGraphQLOperation bool
+
+	// If set, is called after each round trip to decide whether the request should be recorded.
+	// The response may be nil if the round trip failed.
+	ShouldRecord func(req *http.Request, resp *http.Response) bool
+
 	// local vars
 	configCache   *Config
 	configMutex   sync.RWMutex
 	configUpdates int
+	configOnce    sync.Once
+	statsMutex    sync.Mutex
+	stats         Stats
+	limiter       rateLimiter
+	records       recordBuffer
+	// the delivery worker and the config refreshing goroutine, which exit once the context is done
+	background sync.WaitGroup
+	// the capacity of the buffer, the size of its batches and its flush interval, if not the defaults
+	maxBuffered int
+	maxBatched  int
+	flushPeriod time.Duration
+	// the delay after which a record waiting for its response body to be consumed is sent anyway, if not the default
+	bodyTimeout time.Duration
+	breaker     circuitBreaker
+
+	operationalTransportOnce sync.Once
+	operationalTransportPool *http.Transport
+
+	sanitizerOnce  sync.Once
+	sanitizerCache regexSanitizer
+
+	spoolOnce  sync.Once
+	spoolFiles *spool
 }
 
 // Init configures the default http.DefaultTransport with sane default values
@@ -56,54 +429,222 @@ func Init(secretKey string) *Agent {
 	return agent
 }
 
+// Wrap configures the agent to delegate requests to next, and returns the agent.
+// It allows inserting the agent in an existing chain of RoundTrippers, i.e.:
+//
+//	client.Transport = bearer.Init(secretKey).Wrap(otherTransport)
+//
+// The recorded RequestHeaders are those received by the agent, not the ones added by next,
+// see CaptureOutboundRequestHeaders. The agent's own requests to Bearer do not go through next,
+// so they do not get the credentials or spans added by the middlewares of the chain.
+func (a *Agent) Wrap(next http.RoundTripper) *Agent {
+	a.Transport = next
+	return a
+}
+
+// Option configures an agent, i.e., as an argument of WithOptions.
+type Option func(a *Agent)
+
+// WithOptions returns a copy of the agent with opts applied, leaving the agent itself unchanged.
+// The copy shares the configuration of the agent (Logger, Transport, Sanitizer, etc.),
+// but has its own config cache, stats, delivery rate limiter and circuit breaker, i.e.:
+//
+//	sampled := agent.WithOptions(func(a *bearer.Agent) { a.SampleRate = 0.1 })
+func (a *Agent) WithOptions(opts ...Option) *Agent {
+	clone := &Agent{}
+	// only the exported fields are copied, the local vars (including the mutexes) are not shared
+	src := reflect.ValueOf(a).Elem()
+	dst := reflect.ValueOf(clone).Elem()
+	for i := 0; i < src.NumField(); i++ {
+		if src.Type().Field(i).PkgPath == "" {
+			dst.Field(i).Set(src.Field(i))
+		}
+	}
+	for _, opt := range opts {
+		opt(clone)
+	}
+	return clone
+}
+
 // ReplaceGlobals replaces the global http.DefaultTransport, and returns
 // a function to restore the original value.
+//
+// It is safe for concurrent use, and restore functions can be called in any order:
+// restoring a replacement that was itself replaced again only removes it from the chain,
+// so the outermost restore always puts back the original http.DefaultTransport.
 func ReplaceGlobals(n http.RoundTripper) func() {
-	prev := http.DefaultTransport
+	globals.Lock()
+	defer globals.Unlock()
+	entry := &globalsEntry{prev: http.DefaultTransport}
+	globals.stack = append(globals.stack, entry)
 	http.DefaultTransport = n
-	return func() { ReplaceGlobals(prev) }
+	return func() { restoreGlobals(entry) }
+}
+
+type globalsEntry struct {
+	prev http.RoundTripper
+}
+
+var globals struct {
+	sync.Mutex
+	stack []*globalsEntry
+}
+
+func restoreGlobals(entry *globalsEntry) {
+	globals.Lock()
+	defer globals.Unlock()
+	for idx, candidate := range globals.stack {
+		if candidate != entry {
+			continue
+		}
+		if idx == len(globals.stack)-1 {
+			http.DefaultTransport = entry.prev
+		} else {
+			globals.stack[idx+1].prev = entry.prev
+		}
+		globals.stack = append(globals.stack[:idx], globals.stack[idx+1:]...)
+		return
+	}
 }
 
 var (
 	isParseableContentType = regexp.MustCompile(`(?i)json|text|xml|x-www-form-urlencoded`)
+
+	defaultRequestIDHeaders = []string{"X-Request-Id", "X-Amzn-RequestId"}
 )
 
 // RoundTrip implements the http.RoundTripper interface
 func (a *Agent) RoundTrip(req *http.Request) (*http.Response, error) {
-	for _, domain := range a.config().BlockedDomains {
-		if domain == req.URL.Hostname() {
-			return nil, ErrBlockedDomain
+	if a.Disabled {
+		return a.transport().RoundTrip(req)
+	}
+
+	if a.DefaultRequestTimeout > 0 {
+		if _, ok := req.Context().Deadline(); !ok {
+			return a.roundTripWithTimeout(req)
 		}
 	}
 
-	var reqReader io.ReadCloser
-	if req.Body != nil && a.isAvailable() {
-		buf, err := ioutil.ReadAll(req.Body)
+	if a.SafeMode {
+		return a.safeRoundTrip(req)
+	}
+
+	if err := a.blockedDomain(req); err != nil {
+		return nil, err
+	}
+
+	if matchPaths(a.ExcludePaths, req.URL.Path) {
+		return a.transport().RoundTrip(req)
+	}
+
+	var reqBody []byte
+	var streamed *streamedBody
+	if req.Body != nil && a.isAvailable() && isGRPC(req) {
+		// gRPC requests may be streamed while the response is received, so they are counted, not buffered
+		streamed = &streamedBody{ReadCloser: req.Body}
+		req.Body = streamed
+	} else if req.Body != nil && a.isAvailable() {
+		buf, err := readBody(req.Body, a.PoolBuffers)
 		if err != nil {
 			a.logger().Error("read request body", zap.Error(err))
 			return nil, err
 		}
-		reqReader = ioutil.NopCloser(bytes.NewBuffer(buf))
+		reqBody = buf
 		req.Body = ioutil.NopCloser(bytes.NewBuffer(buf))
+		// the original body is consumed, so retries need to replay the buffered one
+		req.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(buf)), nil
+		}
 	}
 
-	start := time.Now()
+	var correlationID string
+	if a.isAvailable() {
+		req, correlationID = a.correlate(req)
+	}
+
+	var site string
+	if a.CaptureCallSite && a.isAvailable() {
+		site = callSite()
+	}
+
+	var trace *requestTrace
+	if (a.CaptureAddrs || a.CaptureDNS || a.CaptureTimings) && a.isAvailable() {
+		trace = &requestTrace{addrs: a.CaptureAddrs, dns: a.CaptureDNS, timings: a.CaptureTimings, now: a.clock().Now}
+		req = trace.withTrace(req)
+	}
+
+	start := a.clock().Now()
 	resp, roundtripError := a.transport().RoundTrip(req)
-	end := time.Now()
+	end := a.clock().Now()
 
-	if a.isAvailable() {
-		record := newRecord(req, resp, start, end, reqReader, a.logger(), roundtripError)
-		go func() {
-			defer func() {
-				if r := recover(); r != nil {
-					a.logger().Error("panic", zap.Any("r", r))
-					// FIXME: log an internal error
+	var redirect *redirectHop
+	if a.CaptureRedirects && a.isAvailable() {
+		redirect = followRedirect(req, resp)
+	}
+
+	cancelled := isCancellation(req, roundtripError)
+	if a.isAvailable() && (!cancelled || a.RecordCancellations) && a.shouldRecord(req, resp) {
+		// upgraded connections are returned untouched
+		upgrade := isUpgrade(req, resp)
+		var timing *timedBody
+		if a.CaptureTimings && resp != nil && resp.Body != nil && !upgrade {
+			timing = &timedBody{ReadCloser: resp.Body, now: a.clock().Now}
+			resp.Body = timing
+		}
+		record := a.newRecord(req, resp, start, end, reqBody, roundtripError)
+		switch {
+		case cancelled:
+			record.Type = RequestCancelled
+		case roundtripError != nil:
+			record.Type = RequestError
+		}
+		if streamed != nil {
+			record.BytesSent = streamed.count()
+		}
+		record.CallSite = site
+		record.CorrelationID = correlationID
+		if redirect != nil {
+			redirect.apply(&record)
+		}
+		if trace != nil {
+			trace.apply(&record)
+		}
+		waitTrailers := a.CaptureTrailers && !a.MetadataOnly && resp != nil && len(resp.Trailer) > 0 && record.ResponseTrailers == nil
+		// the body may have been read by newRecord already
+		waitBody := timing != nil && timing.ended.IsZero()
+		if timing != nil && !waitBody {
+			record.BodyReadTime = int(timing.ended.Sub(end) / time.Millisecond)
+		}
+		// the size of the bodies without Content-Length, i.e., chunked, which were not captured
+		waitLength := resp != nil && resp.ContentLength < 0 && record.BytesReceived == 0 && roundtripError == nil && responseHasBody(req, resp)
+		if (isGRPC(req) || waitTrailers || waitBody || waitLength) && resp != nil && resp.Body != nil && !upgrade {
+			// grpc-status and other trailers are received after the body, and the size of chunked bodies
+			// is only known once read, so the record is sent once the body is consumed, or after a while
+			resp.Body = newDeferredBody(resp.Body, a.deferredTimeout(), func(read int, ended bool) {
+				record.BytesReceived = read
+				if streamed != nil {
+					record.BytesSent = streamed.count()
 				}
-			}()
-			if err := a.logRecords([]reportLog{record}); err != nil {
-				a.logger().Warn("log record", zap.Error(err))
-			}
-		}()
+				// otherwise, the body is still owned by the caller, and the trailers are not received yet
+				if ended {
+					if status, ok := grpcStatus(resp); ok && isGRPC(req) {
+						record.StatusCode = status
+					}
+					if waitTrailers {
+						a.captureTrailers(req, resp, &record)
+					}
+					if waitBody {
+						record.BodyReadTime = int(timing.ended.Sub(end) / time.Millisecond)
+					}
+				}
+				a.sendRecord(record)
+			})
+		} else {
+			a.sendRecord(record)
+		}
+	}
+	if redirect != nil && isRedirect(resp) && resp.Body != nil {
+		resp.Body = &redirectBody{ReadCloser: resp.Body, hop: redirect}
 	}
 
 	// here we can handle retry/circuit-breaking policies, i.e.:
@@ -116,53 +657,428 @@ func (a *Agent) RoundTrip(req *http.Request) (*http.Response, error) {
 	return resp, roundtripError
 }
 
-func newRecord(req *http.Request, resp *http.Response, start, end time.Time, reqReader io.ReadCloser, logger *zap.Logger, roundtripError error) reportLog {
-	record := reportLog{
+// correlate returns the correlation ID of a request, and the request to perform:
+// if CorrelationIDHeader is set, a copy of req with the correlation ID header.
+// Without CorrelationIDHeader, no correlation ID is generated.
+func (a *Agent) correlate(req *http.Request) (*http.Request, string) {
+	if a.CorrelationIDHeader == "" {
+		return req, ""
+	}
+	if id := req.Header.Get(a.CorrelationIDHeader); id != "" {
+		return req, id
+	}
+	id, err := newUUID()
+	if err != nil {
+		a.logger().Warn("generate correlation ID", zap.Error(err))
+		return req, ""
+	}
+	// the caller's request must not be modified
+	copied := *req
+	copied.Header = req.Header.Clone()
+	if copied.Header == nil {
+		copied.Header = http.Header{}
+	}
+	copied.Header.Set(a.CorrelationIDHeader, id)
+	return &copied, id
+}
+
+// blockedDomain returns a BlockedDomainError if the request must be blocked.
+func (a *Agent) blockedDomain(req *http.Request) error {
+	if a.DisableBlocking {
+		return nil
+	}
+	if config := a.config(); config != nil {
+		if pattern, blocked := matchBlockedDomain(config.BlockedDomains, req.URL); blocked {
+			return &BlockedDomainError{Hostname: req.URL.Hostname(), Pattern: pattern}
+		}
+	}
+	return nil
+}
+
+// sendRecord delivers a record to Bearer in a dedicated goroutine,
+// or inline if SynchronousDelivery is set.
+// The record is passed to ProcessRecord first, which can modify or drop it.
+func (a *Agent) sendRecord(record ReportLog) {
+	if a.ProcessRecord != nil && !a.ProcessRecord(&record) {
+		return
+	}
+	if !record.Type.Valid() {
+		a.logger().Warn("invalid record type", zap.String("type", string(record.Type)))
+		return
+	}
+	if a.DryRun {
+		a.logDryRun(record)
+		return
+	}
+	spool := a.spool()
+	var spoolID uint64
+	if spool != nil {
+		id, err := spool.append(record)
+		if err != nil {
+			a.logger().Warn("spool record", zap.Error(err))
+		}
+		spoolID = id
+	}
+	a.deliverRecord(record, spool, spoolID)
+}
+
+// deliverRecord buffers a record to be delivered in the background (or delivers it right away
+// if SynchronousDelivery is set), and removes it from the spool once delivered.
+// If the buffer is full, the record is dropped.
+func (a *Agent) deliverRecord(record ReportLog, spool *spool, spoolID uint64) {
+	a.updateStats(func(stats *Stats) { stats.PendingRecords++ })
+	q := queuedRecord{record: record, spool: spool, spoolID: spoolID, size: a.recordSize(record)}
+	// once the context is done, the delivery worker has exited, and the record fails right away
+	if a.SynchronousDelivery || a.context().Err() != nil {
+		a.deliverBatch([]queuedRecord{q})
+		return
+	}
+	if !a.buffer().push(q, a.bufferSize(), a.batchSize(), a.MaxBatchBytes) {
+		a.updateStats(func(stats *Stats) {
+			stats.PendingRecords--
+			stats.RecordsDropped++
+			stats.BufferOverflows++
+		})
+		a.logger().Debug("buffer full, record dropped", zap.String("url", record.URL))
+	}
+}
+
+// deliverBatch delivers a batch of records, and removes them from the spool once delivered.
+func (a *Agent) deliverBatch(batch []queuedRecord) {
+	defer func() {
+		if r := recover(); r != nil {
+			a.logger().Error("panic", zap.Any("r", r))
+			// FIXME: log an internal error
+		}
+	}()
+	started := time.Now()
+	records := make([]ReportLog, len(batch))
+	for i, q := range batch {
+		records[i] = q.record
+	}
+	err := a.logRecords(records)
+	if a.DeliveryObserver != nil {
+		a.DeliveryObserver(time.Since(started), err)
+	}
+	a.updateStats(func(stats *Stats) {
+		stats.PendingRecords -= len(batch)
+		if err != nil {
+			stats.DeliveryErrors++
+			stats.RecordsDropped += len(batch)
+		} else {
+			stats.RecordsSent += len(batch)
+		}
+	})
+	switch {
+	case errors.Is(err, ErrCircuitOpen):
+		// the opening of the circuit was logged already
+		a.logger().Debug("log records", zap.Error(err))
+	case err != nil:
+		a.logger().Warn("log records", zap.Error(err))
+	}
+	// records rejected by Bearer are not kept, as delivering them again would fail too
+	var deliveryErr *DeliveryError
+	if err == nil || errors.As(err, &deliveryErr) && deliveryErr.StatusCode < 500 {
+		for _, q := range batch {
+			if q.spoolID == 0 {
+				continue
+			}
+			if err := q.spool.remove(q.spoolID); err != nil {
+				a.logger().Warn("unspool record", zap.Error(err))
+			}
+		}
+	}
+	if a.AfterDelivery != nil {
+		a.protect(func() { a.AfterDelivery(records, err) })
+	}
+}
+
+// logDryRun logs the record that would have been sent to Bearer.
+func (a *Agent) logDryRun(record ReportLog) {
+	out, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		a.logger().Warn("marshal record", zap.Error(err))
+		return
+	}
+	a.logger().Info("bearer dry run: record not sent", zap.String("record", string(out)))
+}
+
+func (a *Agent) newRecord(req *http.Request, resp *http.Response, start, end time.Time, reqBody []byte, roundtripError error) ReportLog {
+	record := ReportLog{
 		Protocol:  req.URL.Scheme,
 		Path:      req.URL.Path,
 		Hostname:  req.URL.Hostname(),
 		Method:    req.Method,
 		StartedAt: int(start.UnixNano() / 1000000),
 		EndedAt:   int(end.UnixNano() / 1000000),
-		Type:      "REQUEST_END",
+		Type:      RequestEnd,
 		URL:       req.URL.String(),
+		BytesSent: len(reqBody),
+	}
+	switch {
+	case a.MetadataOnly:
+		u := *req.URL
+		u.User = nil
+		u.RawQuery = ""
+		u.ForceQuery = false
+		u.Fragment = ""
+		record.URL = u.String()
+	case a.StripQueryParams:
+		u := *req.URL
+		u.RawQuery = ""
+		u.ForceQuery = false
+		record.URL = u.String()
+	default:
+		record.QueryParams = goQueryToBearerQueryParams(req.URL.Query())
+	}
+	if len(a.LatencyThresholds) > 0 {
+		record.LatencyBucket = latencyBucket(end.Sub(start), a.LatencyThresholds)
+	}
+	record.RequestID = a.requestID(req, resp)
+	record.Attempt = attempt(req)
+	if len(a.StaticTags) > 0 {
+		record.Tags = make(map[string]string, len(a.StaticTags))
+		for k, v := range a.StaticTags {
+			record.Tags[k] = v
+		}
 	}
 	if resp != nil {
 		record.StatusCode = resp.StatusCode
-		record.RequestHeaders = goHeadersToBearerHeaders(req.Header)
-		record.ResponseHeaders = goHeadersToBearerHeaders(resp.Header)
+		record.ProtoVersion = resp.Proto
+		if resp.ContentLength > 0 {
+			record.BytesReceived = int(resp.ContentLength)
+		}
+		if !a.MetadataOnly {
+			record.RequestHeaders = goHeadersToBearerHeaders(req.Header, a.CaptureRequestHeaders)
+			record.ResponseHeaders = goHeadersToBearerHeaders(resp.Header, a.CaptureResponseHeaders)
+			dropHeaders(record.RequestHeaders, a.DropHeaders)
+			dropHeaders(record.ResponseHeaders, a.DropHeaders)
+			record.TruncatedRequestHeaders = truncateHeaders(record.RequestHeaders, a.MaxHeaders)
+			record.TruncatedResponseHeaders = truncateHeaders(record.ResponseHeaders, a.MaxHeaders)
+			if a.CaptureOutboundRequestHeaders && resp.Request != nil {
+				record.OutboundRequestHeaders = goHeadersToBearerHeaders(resp.Request.Header, a.CaptureRequestHeaders)
+				dropHeaders(record.OutboundRequestHeaders, a.DropHeaders)
+				truncateHeaders(record.OutboundRequestHeaders, a.MaxHeaders)
+			}
+		}
+		if resp.TLS != nil {
+			record.TLSVersion = tlsVersionName(resp.TLS.Version)
+			record.CipherSuite = tls.CipherSuiteName(resp.TLS.CipherSuite)
+		}
 	}
-	if roundtripError == nil && resp.Body != nil && isParseableContentType.MatchString(record.RequestContentType()) {
-		buf, _ := ioutil.ReadAll(resp.Body)
-		respReader := ioutil.NopCloser(bytes.NewBuffer(buf))
-		resp.Body = ioutil.NopCloser(bytes.NewBuffer(buf))
-		respBody, _ := ioutil.ReadAll(respReader)
-		record.ResponseBody = string(respBody)
+	if isGRPC(req) {
+		// gRPC bodies are binary, only the method and the status are recorded
+		record.GRPCMethod = req.URL.Path
+		if status, ok := grpcStatus(resp); ok {
+			record.StatusCode = status
+		}
 	}
-	if reqReader != nil && isParseableContentType.MatchString(record.ResponseContentType()) {
-		reqBody, _ := ioutil.ReadAll(reqReader)
-		record.RequestBody = string(reqBody)
+	settings := a.hostSettings(req.URL.Hostname())
+	captureBodies := !a.MetadataOnly && !isGRPC(req) && !isUpgrade(req, resp) && !settings.SkipBodies && a.shouldCaptureBodies(resp, roundtripError)
+	// the body of a redirect is only a link to its Location, discarded by the client following it
+	captureResponseBody := captureBodies && roundtripError == nil && responseHasBody(req, resp) && !isRedirect(resp)
+	if captureResponseBody && isParseableContentType.MatchString(record.ResponseContentType()) {
+		if buf, ok := a.readResponseBody(resp); !ok {
+			record.ResponseBodySkipped = true
+		} else {
+			record.BytesReceived = len(buf)
+			respBody, err := decodeBodyString(buf, resp.Header.Get("Content-Encoding"), a.PoolBuffers)
+			if err != nil {
+				a.logger().Warn("decode response body", zap.Error(err))
+			} else {
+				record.ResponseBody = respBody
+			}
+		}
+	}
+	if captureBodies && reqBody != nil && isParseableContentType.MatchString(record.RequestContentType()) {
+		decoded, err := decodeBodyString(reqBody, req.Header.Get("Content-Encoding"), a.PoolBuffers)
+		if err != nil {
+			a.logger().Warn("decode request body", zap.Error(err))
+		} else {
+			record.RequestBody = decoded
+			if strings.HasPrefix(record.RequestContentType(), "application/x-www-form-urlencoded") {
+				if form, err := url.ParseQuery(record.RequestBody); err == nil {
+					record.RequestForm = goQueryToBearerQueryParams(form)
+				}
+			}
+		}
+	}
+	if a.CaptureGraphQLOperation && record.RequestBody != "" && strings.HasPrefix(record.RequestContentType(), "application/json") {
+		record.GraphQLOperation = graphQLOperation(record.RequestBody, matchPaths(a.GraphQLPaths, req.URL.Path))
 	}
-	if err := record.sanitize(); err != nil {
-		logger.Warn("sanitize record", zap.Error(err))
+	if a.CaptureTrailers && !a.MetadataOnly && resp != nil {
+		// only available if the body was read above
+		record.ResponseTrailers = goTrailersToBearerHeaders(resp.Trailer)
+		dropHeaders(record.ResponseTrailers, a.DropHeaders)
+	}
+	var reqDigest, respDigest string
+	if a.HashBodies {
+		reqDigest, respDigest = hashBody(record.RequestBody), hashBody(record.ResponseBody)
+	}
+	// in MetadataOnly mode, the path and the tags are still sanitized
+	if !settings.DisableSanitization {
+		if err := a.sanitizer().Sanitize(&record); err != nil {
+			a.logger().Warn("sanitize record", zap.Error(err))
+		}
+	}
+	if reqDigest != "" || respDigest != "" {
+		// the digests are set after sanitization, which could alter them
+		record.RequestBody, record.ResponseBody = reqDigest, respDigest
+		record.RequestForm = nil
+		record.BodiesHashed = true
+		return record
+	}
+	if a.CompactJSONBodies {
+		record.RequestBody = compactJSONBody(record.RequestBody, record.RequestContentType())
+		record.ResponseBody = compactJSONBody(record.ResponseBody, record.ResponseContentType())
+	}
+	if max := a.maxBodySize(req); max > 0 {
+		a.truncateBodies(&record, max)
+	}
+	if a.EncodeBinaryBodies {
+		record.RequestBody, record.RequestBodyEncoding = encodeBinaryBody(record.RequestBody)
+		record.ResponseBody, record.ResponseBodyEncoding = encodeBinaryBody(record.ResponseBody)
 	}
 	return record
 }
 
+// truncateBodies truncates the bodies of record to max bytes.
+func (a *Agent) truncateBodies(record *ReportLog, max int) {
+	truncated := 0
+	if len(record.RequestBody) > max {
+		record.OriginalRequestBodySize = len(record.RequestBody)
+		record.RequestBody = truncateBody(record.RequestBody, max)
+		truncated++
+	}
+	if len(record.ResponseBody) > max {
+		record.OriginalResponseBodySize = len(record.ResponseBody)
+		record.ResponseBody = truncateBody(record.ResponseBody, max)
+		truncated++
+	}
+	if truncated == 0 {
+		return
+	}
+	a.updateStats(func(stats *Stats) { stats.TruncatedBodies += truncated })
+	if a.WarnOnTruncatedBodies {
+		a.logger().Warn("body truncated",
+			zap.String("url", record.URL),
+			zap.Int("maxBodySize", max),
+			zap.Int("requestBodySize", record.OriginalRequestBodySize),
+			zap.Int("responseBodySize", record.OriginalResponseBodySize),
+		)
+	}
+}
+
+// requestID returns the value of the first RequestIDHeaders found on the response, or else on the request.
+func (a *Agent) requestID(req *http.Request, resp *http.Response) string {
+	names := a.RequestIDHeaders
+	if len(names) == 0 {
+		names = defaultRequestIDHeaders
+	}
+	if resp != nil {
+		if id := firstHeader(resp.Header, names); id != "" {
+			return id
+		}
+	}
+	return firstHeader(req.Header, names)
+}
+
+// captureTrailers records the trailers of a response whose body has been consumed.
+func (a *Agent) captureTrailers(req *http.Request, resp *http.Response, record *ReportLog) {
+	trailers := ReportLog{ResponseTrailers: goTrailersToBearerHeaders(resp.Trailer)}
+	dropHeaders(trailers.ResponseTrailers, a.DropHeaders)
+	if !a.hostSettings(req.URL.Hostname()).DisableSanitization {
+		if err := a.sanitizer().Sanitize(&trailers); err != nil {
+			a.logger().Warn("sanitize trailers", zap.Error(err))
+		}
+	}
+	record.ResponseTrailers = trailers.ResponseTrailers
+}
+
+// isCancellation returns true if the round trip failed because the context of the request
+// was cancelled or timed out, as opposed to a network or server failure.
+func isCancellation(req *http.Request, roundtripError error) bool {
+	if roundtripError == nil {
+		return false
+	}
+	if errors.Is(roundtripError, context.Canceled) || errors.Is(roundtripError, context.DeadlineExceeded) {
+		return true
+	}
+	return req.Context().Err() != nil
+}
+
+// responseHasBody returns false if the response has no body by definition:
+// responses to HEAD requests, and 204 No Content and 304 Not Modified responses.
+func responseHasBody(req *http.Request, resp *http.Response) bool {
+	if resp.Body == nil || req.Method == http.MethodHead {
+		return false
+	}
+	return resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusNotModified
+}
+
+// readResponseBody buffers the body of resp, and replaces it with the buffered copy for the application.
+// It returns false, without buffering the body, if it is larger than MaxCapturedResponseSize.
+func (a *Agent) readResponseBody(resp *http.Response) ([]byte, bool) {
+	limit := a.MaxCapturedResponseSize
+	if limit <= 0 {
+		buf, _ := readBody(resp.Body, a.PoolBuffers)
+		resp.Body = ioutil.NopCloser(bytes.NewBuffer(buf))
+		return buf, true
+	}
+	if resp.ContentLength > int64(limit) {
+		return nil, false
+	}
+	// the Content-Length may be unknown, so one more byte than the limit tells if the body exceeds it
+	buf, _ := readBody(io.LimitReader(resp.Body, int64(limit)+1), a.PoolBuffers)
+	if len(buf) > limit {
+		resp.Body = &prefixedBody{Reader: io.MultiReader(bytes.NewReader(buf), resp.Body), Closer: resp.Body}
+		return nil, false
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewBuffer(buf))
+	return buf, true
+}
+
+// prefixedBody is a body whose first bytes were already read, which are replayed before the rest.
+type prefixedBody struct {
+	io.Reader
+	io.Closer
+}
+
 func (a *Agent) isAvailable() bool {
 	return a.SecretKey != ""
 }
 
+// shouldCaptureBodies returns false if bodies should be skipped because the request succeeded
+// and CaptureBodiesOnErrorOnly is set.
+func (a *Agent) shouldCaptureBodies(resp *http.Response, roundtripError error) bool {
+	if !a.CaptureBodiesOnErrorOnly || roundtripError != nil || resp == nil {
+		return true
+	}
+	return resp.StatusCode >= 400
+}
+
+func (a *Agent) shouldRecord(req *http.Request, resp *http.Response) bool {
+	rate := a.SampleRate
+	if settings := a.hostSettings(req.URL.Hostname()); settings.SampleRate > 0 {
+		rate = settings.SampleRate
+	}
+	if rate > 0 && rate < 1 && rand.Float64() >= rate {
+		return false
+	}
+	if a.ShouldRecord != nil {
+		return a.ShouldRecord(req, resp)
+	}
+	return true
+}
+
 // Config fetches and returns a fresh Bearer configuration for your current token
-func (a Agent) Config() (*Config, error) {
-	req, err := http.NewRequest("GET", "https://config.bearer.sh/config", nil)
+func (a *Agent) Config() (*Config, error) {
+	req, err := a.newConfigRequest(context.Background())
 	if err != nil {
-		return nil, fmt.Errorf("create config request: %w", err)
+		return nil, err
 	}
-	req.Header.Add("Accept", "application/json")
-	req.Header.Add("Authorization", a.SecretKey)
 
-	ret, err := a.transport().RoundTrip(req)
+	ret, err := a.operationalTransport().RoundTrip(req)
 	if err != nil {
 		return nil, err
 	}
@@ -181,131 +1097,520 @@ func (a Agent) Config() (*Config, error) {
 	return &config, nil
 }
 
-// Flush flushes any buffered log entries. Applications should take care to call Flush before exiting.
-func (a Agent) Flush() error {
-	// FIXME: this function is just a placeholder before we switch to a new async mechanism
+// ValidateSecretKey checks the SecretKey against Bearer, by fetching the config, so that a misconfigured
+// program can fail at startup instead of failing to deliver records in the background, i.e.:
+//
+//	if err := agent.ValidateSecretKey(ctx); errors.Is(err, bearer.ErrInvalidSecretKey) {
+//		log.Fatal(err)
+//	}
+//
+// If Bearer rejects the key, the error matches ErrInvalidSecretKey with errors.Is.
+// Other errors, i.e., network errors, mean that the key could not be checked.
+func (a *Agent) ValidateSecretKey(ctx context.Context) error {
+	if a.SecretKey == "" {
+		return fmt.Errorf("%w: empty", ErrInvalidSecretKey)
+	}
+	req, err := a.newConfigRequest(ctx)
+	if err != nil {
+		return err
+	}
+	resp, err := a.operationalTransport().RoundTrip(req)
+	if err != nil {
+		return fmt.Errorf("validate secret key: %w", err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return fmt.Errorf("%w: status code %d", ErrInvalidSecretKey, resp.StatusCode)
+	case resp.StatusCode >= 300:
+		return fmt.Errorf("validate secret key: unsupported status code: %d", resp.StatusCode)
+	}
 	return nil
 }
 
-func (a Agent) context() context.Context {
+// newConfigRequest returns an authenticated request fetching the config.
+func (a *Agent) newConfigRequest(ctx context.Context) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", "https://config.bearer.sh/config", nil)
+	if err != nil {
+		return nil, fmt.Errorf("create config request: %w", err)
+	}
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("Authorization", a.SecretKey)
+	req.Header.Set("User-Agent", a.userAgent())
+	return req, nil
+}
+
+// Stats returns a snapshot of the agent's internal counters.
+func (a *Agent) Stats() Stats {
+	a.configMutex.RLock()
+	configUpdates := a.configUpdates
+	a.configMutex.RUnlock()
+
+	a.statsMutex.Lock()
+	defer a.statsMutex.Unlock()
+	stats := a.stats
+	stats.ConfigUpdates = configUpdates
+	if a.CircuitBreakerThreshold > 0 {
+		stats.CircuitState = a.breaker.state(a.clock().Now(), a.circuitBreakerCooldown())
+	}
+	return stats
+}
+
+// BufferLen returns the number of records in the buffer, waiting for the delivery worker.
+// Unlike Stats.PendingRecords, the records being delivered are not counted.
+// It is cheaper than taking a Stats snapshot, i.e., to be polled for autoscaling or alerting along with BufferCapacity.
+func (a *Agent) BufferLen() int {
+	return a.records.len()
+}
+
+// BufferCapacity returns the number of records the buffer can hold (1000), beyond which records are dropped.
+func (a *Agent) BufferCapacity() int {
+	return a.bufferSize()
+}
+
+func (a *Agent) updateStats(fn func(stats *Stats)) {
+	a.statsMutex.Lock()
+	fn(&a.stats)
+	a.statsMutex.Unlock()
+}
+
+// Flush waits for the pending records to be delivered, for at most FlushTimeout.
+// Applications should take care to call Flush before exiting.
+func (a *Agent) Flush() error {
+	timeout := a.FlushTimeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(a.context(), timeout)
+	defer cancel()
+	return a.FlushContext(ctx)
+}
+
+// FlushContext waits for the pending records to be delivered, or for ctx to be done.
+// In the latter case, the returned error contains the number of undelivered records.
+// If SpoolDir is set, the records left by previous processes are delivered too.
+func (a *Agent) FlushContext(ctx context.Context) error {
+	a.spool()
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		pending := a.Stats().PendingRecords
+		if pending == 0 {
+			return nil
+		}
+		// the buffered records are delivered without waiting for the flush interval
+		notify(a.buffer().ready)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return fmt.Errorf("flush: %d undelivered records: %w", pending, ctx.Err())
+		}
+	}
+}
+
+// userAgent returns the User-Agent of the agent's own requests to Bearer.
+func (a *Agent) userAgent() string {
+	if a.ServiceName == "" {
+		return "bearer-go/" + version
+	}
+	return "bearer-go/" + version + " (" + a.ServiceName + ")"
+}
+
+func (a *Agent) context() context.Context {
 	if a.Context != nil {
 		return a.Context
 	}
 	return context.Background()
 }
 
-func (a Agent) logger() *zap.Logger {
+func (a *Agent) logger() *zap.Logger {
 	if a.Logger != nil {
 		return a.Logger
 	}
+	if a.LeveledLogger != nil {
+		return newLeveledZapLogger(a.LeveledLogger)
+	}
 	return zap.NewNop()
 }
 
-func (a Agent) transport() http.RoundTripper {
+func (a *Agent) clock() Clock {
+	if a.Clock != nil {
+		return a.Clock
+	}
+	return realClock{}
+}
+
+// sanitizer returns the Sanitizer of the agent, the built-in one being built once from the agent's options.
+func (a *Agent) sanitizer() Sanitizer {
+	if a.Sanitizer != nil {
+		return a.Sanitizer
+	}
+	a.sanitizerOnce.Do(func() {
+		a.sanitizerCache = a.newSanitizer()
+	})
+	return a.sanitizerCache
+}
+
+// newSanitizer builds the built-in sanitizer configured by the agent's options.
+func (a *Agent) newSanitizer() regexSanitizer {
+	sanitizer := defaultSanitizer
+	if a.SensitiveKeys != nil {
+		sanitizer.keys = a.SensitiveKeys
+	}
+	if a.SensitiveValues != nil {
+		sanitizer.values = a.SensitiveValues
+	}
+	sanitizer.redactAllCookies = a.RedactAllCookies
+	sanitizer.partialAuthorization = a.PartialAuthorizationRedaction
+	if len(a.HeaderRules) > 0 {
+		sanitizer.headerRules = make(map[string]HeaderRule, len(a.HeaderRules))
+		for name, rule := range a.HeaderRules {
+			sanitizer.headerRules[strings.ToLower(name)] = rule
+		}
+	}
+	sanitizer.basicCredentials = a.RedactBasicCredentials
+	sanitizer.luhnCardNumbers = a.RedactLuhnCardNumbers
+	sanitizer.ibans = a.RedactIBANs
+	sanitizer.bics = a.RedactBICs
+	sanitizer.graphQLPaths = a.GraphQLPaths
+	if len(a.SecretStrings) > 0 {
+		sanitizer.secretStrings = secretStringsReplacer(a.SecretStrings, sanitizer.placeholder)
+	}
+	if a.RedactPhoneNumbers {
+		sanitizer.phoneNumbers = phoneNumbers(a.PhoneNumberRegions)
+	}
+	for _, profile := range a.SensitiveKeyProfiles {
+		if sanitizer.profileKeys == nil {
+			sanitizer.profileKeys = map[string]bool{}
+		}
+		for _, key := range profile {
+			sanitizer.profileKeys[strings.ToLower(key)] = true
+		}
+	}
+	for _, name := range a.Profiles {
+		profile, ok := RedactionProfiles[strings.ToLower(name)]
+		if !ok {
+			continue
+		}
+		if sanitizer.profileKeys == nil {
+			sanitizer.profileKeys = map[string]bool{}
+		}
+		for _, key := range profile.Keys {
+			sanitizer.profileKeys[strings.ToLower(key)] = true
+		}
+		for _, values := range profile.Values {
+			if values == cardNumberCandidate {
+				// as with RedactLuhnCardNumbers, so that timestamps and numeric IDs are kept
+				sanitizer.luhnCardNumbers = true
+				continue
+			}
+			sanitizer.profileValues = append(sanitizer.profileValues, values)
+		}
+	}
+	if len(a.RedactJSONPaths) > 0 {
+		sanitizer.jsonPaths = make(map[string]bool, len(a.RedactJSONPaths))
+		for _, path := range a.RedactJSONPaths {
+			sanitizer.jsonPaths[strings.TrimPrefix(path, "$.")] = true
+		}
+	}
+	return sanitizer
+}
+
+// secretStringsReplacer returns a Replacer of the non-empty secrets by placeholder.
+// Longer secrets are replaced first, so that a secret containing another is fully replaced.
+func secretStringsReplacer(secrets []string, placeholder string) *strings.Replacer {
+	sorted := make([]string, 0, len(secrets))
+	for _, secret := range secrets {
+		if secret != "" {
+			sorted = append(sorted, secret)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool { return len(sorted[i]) > len(sorted[j]) })
+	pairs := make([]string, 0, 2*len(sorted))
+	for _, secret := range sorted {
+		pairs = append(pairs, secret, placeholder)
+	}
+	return strings.NewReplacer(pairs...)
+}
+
+// phoneNumbers returns the regexes of the phone number formats of regions, or of all formats if empty.
+func phoneNumbers(regions []string) []*regexp.Regexp {
+	if len(regions) == 0 {
+		regions = []string{"E164", "US", "FR", "GB"}
+	}
+	var ret []*regexp.Regexp
+	for _, region := range regions {
+		if format, ok := phoneNumberFormats[strings.ToUpper(region)]; ok {
+			ret = append(ret, format)
+		}
+	}
+	return ret
+}
+
+// spool returns the spool of the records being delivered, or nil if SpoolDir is not set.
+// On the first call, it opens the spool and delivers the records left by previous processes.
+func (a *Agent) spool() *spool {
+	if a.SpoolDir == "" {
+		return nil
+	}
+	a.spoolOnce.Do(func() {
+		spool, replayed, err := openSpool(a.SpoolDir)
+		if err != nil {
+			a.logger().Warn("open spool", zap.Error(err))
+		}
+		a.spoolFiles = spool
+		for _, spooled := range replayed {
+			a.deliverRecord(spooled.record, spool, spooled.id)
+		}
+	})
+	return a.spoolFiles
+}
+
+func (a *Agent) transport() http.RoundTripper {
 	if a.Transport != nil {
 		return a.Transport
 	}
 	return defaultHTTPTransport
 }
 
+// operationalTransport returns the RoundTripper used for the agent's own requests to Bearer.
+// Each agent has a dedicated small pool of connections, so operational requests do not compete
+// with the application's requests. They do not go through Transport, so that OperationalProxy applies in any case.
+func (a *Agent) operationalTransport() http.RoundTripper {
+	if a.OperationalTransport != nil {
+		return a.OperationalTransport
+	}
+	a.operationalTransportOnce.Do(func() {
+		transport := defaultHTTPTransport.Clone()
+		if a.OperationalProxy != nil {
+			transport.Proxy = a.OperationalProxy
+		}
+		transport.MaxIdleConns = a.OperationalMaxIdleConns
+		if transport.MaxIdleConns <= 0 {
+			transport.MaxIdleConns = 2
+		}
+		transport.MaxIdleConnsPerHost = transport.MaxIdleConns
+		transport.IdleConnTimeout = a.OperationalIdleConnTimeout
+		if transport.IdleConnTimeout <= 0 {
+			transport.IdleConnTimeout = 30 * time.Second
+		}
+		a.operationalTransportPool = transport
+	})
+	return a.operationalTransportPool
+}
+
+// config returns the current config, without blocking.
+// On the first call, it starts fetching the config in the background,
+// and returns the InitialConfig (if any) until the first fetch completes.
+// The refreshing goroutine is started exactly once, even if fetches fail.
 func (a *Agent) config() *Config {
-	a.configMutex.Lock()
-	defer a.configMutex.Unlock()
-	if a.configCache == nil {
-		var err error
-		a.configUpdates++
-		a.configCache, err = a.Config()
-		if err != nil {
-			a.logger().Warn("fetch bearer config", zap.Error(err))
-			return nil
+	a.configOnce.Do(func() {
+		a.configMutex.Lock()
+		defer a.configMutex.Unlock()
+		if a.configCache == nil {
+			a.configCache = a.InitialConfig
+			a.background.Add(1)
+			go a.refreshConfig(a.InitialConfig == nil)
 		}
+	})
 
-		// start a goroutine to refresh config regularly
-		duration := a.RefreshConfigEvery
-		if duration <= 0 {
-			duration = 5 * time.Second
-		}
-		go func() {
-			for {
-				time.Sleep(duration)
-				newConfig, err := a.Config()
-				if err != nil {
-					a.logger().Warn("fetch bearer config", zap.Error(err))
-				} else {
-					a.configMutex.Lock()
-					a.configUpdates++
-					a.configCache = newConfig
-					a.configMutex.Unlock()
-				}
+	a.configMutex.RLock()
+	defer a.configMutex.RUnlock()
+	return a.configCache
+}
+
+// refreshConfig fetches the config regularly, starting immediately if now is true,
+// until the agent's context is done.
+func (a *Agent) refreshConfig(now bool) {
+	defer a.background.Done()
+	duration := a.RefreshConfigEvery
+	if duration <= 0 {
+		duration = 5 * time.Second
+	}
+	done := a.context().Done()
+	for {
+		if !now {
+			timer := time.NewTimer(duration)
+			select {
+			case <-timer.C:
+			case <-done:
+				timer.Stop()
+				return
 			}
-		}()
+		}
+		now = false
+		newConfig, err := a.Config()
+		if err != nil {
+			a.logger().Warn("fetch bearer config", zap.Error(err))
+			continue
+		}
+		a.configMutex.Lock()
+		a.configUpdates++
+		a.configCache = newConfig
+		a.configMutex.Unlock()
 	}
-
-	return a.configCache
 }
 
-func (a Agent) logRecords(records []reportLog) error {
+func (a *Agent) logRecords(records []ReportLog) error {
 	if len(records) < 1 {
 		return nil
 	}
+	if a.DeduplicateBatch {
+		records = deduplicateRecords(records)
+	}
+	// the agent's context is done, i.e., the application is shutting down
+	if err := a.context().Err(); err != nil {
+		return fmt.Errorf("deliver records: %w", err)
+	}
+
+	// records are delivered to each sink, even if the delivery to another one failed
+	var errs sinkErrors
+	if err := a.sendToBearer(records); err != nil {
+		errs = append(errs, err)
+	}
+	for _, sink := range a.Sinks {
+		if err := sink.Send(a.context(), records); err != nil {
+			errs = append(errs, fmt.Errorf("deliver to sink: %w", err))
+		}
+	}
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	default:
+		return errs
+	}
+}
+
+// fitRecord truncates the bodies of an oversized record until it is encoded in at most MaxBatchBytes,
+// and returns its encoding. If the record is still too large without bodies, the encoding is too.
+func (a *Agent) fitRecord(record ReportLog, marshal Marshaler) ([]byte, string, error) {
+	for {
+		body, contentType, err := marshal([]ReportLog{record}, a.newLogsMetadata())
+		if err != nil {
+			return nil, "", fmt.Errorf("marshal records: %w", err)
+		}
+		excess := len(body) - a.MaxBatchBytes
+		if excess <= 0 || record.RequestBody == "" && record.ResponseBody == "" {
+			return body, contentType, nil
+		}
+		// as encoded bodies are at least as large as raw ones, removing excess bytes usually fits
+		largest, originalSize := &record.ResponseBody, &record.OriginalResponseBodySize
+		if len(record.RequestBody) > len(record.ResponseBody) {
+			largest, originalSize = &record.RequestBody, &record.OriginalRequestBodySize
+		}
+		if *originalSize == 0 {
+			*originalSize = len(*largest)
+		}
+		keep := len(*largest) - excess
+		if keep < 0 {
+			keep = 0
+		}
+		*largest = truncateBody(*largest, keep)
+	}
+}
 
-	type logsRequest struct {
-		SecretKey string `json:"secretKey"`
-		Runtime   struct {
-			Type    string `json:"type"`
-			Version string `json:"version"`
-		} `json:"runtime"`
-		Agent struct {
-			Type     string `json:"type"`
-			Version  string `json:"version"`
-			LogLevel string `json:"log_level"`
-			// FIXME: Config
-		} `json:"agent"`
-		Logs []reportLog `json:"logs"`
-	}
-	input := logsRequest{SecretKey: a.SecretKey, Logs: records}
-	input.Runtime.Type = "go"
-	input.Runtime.Version = runtime.Version()
-	input.Agent.Type = "bearer-go"
-	input.Agent.Version = version
-	input.Agent.LogLevel = "ALL"
-
-	inputJSON, err := json.Marshal(input)
+// sendToBearer delivers records to Bearer's API.
+// Batches larger than MaxBatchBytes are split in halves, delivered by separate requests.
+func (a *Agent) sendToBearer(records []ReportLog) error {
+	marshal := a.Marshaler
+	if marshal == nil {
+		marshal = JSONMarshaler
+	}
+	body, contentType, err := marshal(records, a.newLogsMetadata())
 	if err != nil {
+		return fmt.Errorf("marshal records: %w", err)
+	}
+	if a.MaxBatchBytes > 0 && len(body) > a.MaxBatchBytes && len(records) > 1 {
+		half := len(records) / 2
+		err := a.sendToBearer(records[:half])
+		if err2 := a.sendToBearer(records[half:]); err == nil {
+			err = err2
+		}
 		return err
 	}
-	reqBody := ioutil.NopCloser(strings.NewReader(string(inputJSON)))
-	req, err := http.NewRequest("POST", "https://agent.bearer.sh/logs", reqBody)
+	if a.MaxBatchBytes > 0 && len(body) > a.MaxBatchBytes {
+		a.updateStats(func(stats *Stats) { stats.OversizedRecords++ })
+		if !a.DropOversizedRecords {
+			body, contentType, err = a.fitRecord(records[0], marshal)
+			if err != nil {
+				return err
+			}
+		}
+		if len(body) > a.MaxBatchBytes {
+			a.logger().Warn("record larger than MaxBatchBytes dropped", zap.String("url", records[0].URL), zap.Int("size", len(body)))
+			// Bearer's API would reject it the same way, and it must not be delivered again
+			return &DeliveryError{StatusCode: http.StatusRequestEntityTooLarge, Message: "record larger than MaxBatchBytes"}
+		}
+	}
+
+	if a.CircuitBreakerThreshold > 0 && !a.breaker.allow(a.clock().Now(), a.circuitBreakerCooldown()) {
+		return ErrCircuitOpen
+	}
+	if err := a.limiter.wait(a.context(), a.MaxDeliveriesPerSecond); err != nil {
+		a.breaker.cancel()
+		return fmt.Errorf("wait for delivery: %w", err)
+	}
+	reqBody := ioutil.NopCloser(bytes.NewReader(body))
+	req, err := http.NewRequestWithContext(a.context(), "POST", "https://agent.bearer.sh/logs", reqBody)
 	if err != nil {
+		a.breaker.cancel()
 		return fmt.Errorf("create logs request: %w", err)
 	}
 	req.Header.Add("Accept", "application/json")
-	req.Header.Add("Content-Type", "application/json")
-	ret, err := a.transport().RoundTrip(req)
+	req.Header.Add("Content-Type", contentType)
+	req.Header.Set("User-Agent", a.userAgent())
+	ret, err := a.operationalTransport().RoundTrip(req)
 	if err != nil {
+		a.recordDelivery(true)
 		return fmt.Errorf("perform logs request: %w", err)
 	}
 	defer ret.Body.Close()
+	// Bearer rejecting the records (4xx) is not an outage
+	a.recordDelivery(ret.StatusCode >= 500)
 	switch ret.StatusCode {
 	case 200:
 		return nil
 	default:
-		/*
-			body, err := ioutil.ReadAll(ret.Body)
-			if err != nil {
-				return fmt.Errorf("read logs body: %w", err)
-			}
-			var resp struct {
-				Code    string `json:"code"`
-				Message string `json:"message"`
-			}
-			if err := json.Unmarshal(body, &resp); err != nil {
-				return fmt.Errorf("parse logs response: %w", err)
-			}
-		*/
+		deliveryErr := &DeliveryError{StatusCode: ret.StatusCode}
+		body, err := ioutil.ReadAll(ret.Body)
+		if err != nil {
+			a.logger().Debug("read logs body", zap.Error(err))
+			return deliveryErr
+		}
+		var resp struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		}
+		if err := json.Unmarshal(body, &resp); err != nil {
+			// the body is not a structured error, i.e., an error page of a proxy
+			a.logger().Debug("parse logs response", zap.Error(err))
+			return deliveryErr
+		}
+		deliveryErr.Code = resp.Code
+		deliveryErr.Message = resp.Message
+		return deliveryErr
+	}
+}
+
+// recordDelivery updates the circuit breaker with the result of a delivery to Bearer.
+func (a *Agent) recordDelivery(failed bool) {
+	if a.CircuitBreakerThreshold <= 0 {
+		return
+	}
+	if a.breaker.done(a.clock().Now(), failed, a.CircuitBreakerThreshold) {
+		a.logger().Warn("deliveries suspended after consecutive failures", zap.Duration("cooldown", a.circuitBreakerCooldown()))
+	}
+}
 
-		return fmt.Errorf("unsupported status code: %d", ret.StatusCode)
+func (a *Agent) circuitBreakerCooldown() time.Duration {
+	if a.CircuitBreakerCooldown > 0 {
+		return a.CircuitBreakerCooldown
 	}
+	return 30 * time.Second
 }
 
 // defaultHTTPTransport is the same as the stdlib http.DefaultTransport
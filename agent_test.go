@@ -1,16 +1,33 @@
 package bearer
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
 )
 
 func TestAgent_Config(t *testing.T) {
@@ -24,6 +41,36 @@ func TestAgent_Config(t *testing.T) {
 	assert.NotNil(t, config)
 }
 
+func TestAgent_ValidateSecretKey(t *testing.T) {
+	endpoint := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		switch req.Header.Get("Authorization") {
+		case "sk_valid":
+			return fakeResponse(req, 200, "{}"), nil
+		case "sk_unreachable":
+			return nil, errors.New("connection refused")
+		default:
+			return fakeResponse(req, 401, `{"error":"unauthorized"}`), nil
+		}
+	})
+
+	agent := &Agent{SecretKey: "sk_valid", Transport: endpoint, OperationalTransport: endpoint}
+	assert.NoError(t, agent.ValidateSecretKey(context.Background()))
+
+	agent = &Agent{SecretKey: "sk_wrong", Transport: endpoint, OperationalTransport: endpoint}
+	err := agent.ValidateSecretKey(context.Background())
+	assert.True(t, errors.Is(err, ErrInvalidSecretKey))
+	assert.EqualError(t, err, "bearer: invalid secret key: status code 401")
+
+	agent = &Agent{Transport: endpoint}
+	assert.True(t, errors.Is(agent.ValidateSecretKey(context.Background()), ErrInvalidSecretKey))
+
+	// the key could not be checked
+	agent = &Agent{SecretKey: "sk_unreachable", Transport: endpoint, OperationalTransport: endpoint}
+	err = agent.ValidateSecretKey(context.Background())
+	assert.Error(t, err)
+	assert.False(t, errors.Is(err, ErrInvalidSecretKey))
+}
+
 func TestAgent_config(t *testing.T) {
 	sk := os.Getenv("BEARER_SECRETKEY")
 	if sk == "" {
@@ -32,6 +79,8 @@ func TestAgent_config(t *testing.T) {
 	duration := 500 * time.Millisecond
 	agent := Agent{SecretKey: sk, RefreshConfigEvery: duration}
 
+	agent.config()
+	time.Sleep(200 * time.Millisecond) // the first fetch is done in the background
 	config := agent.config()
 	assert.NotNil(t, config)
 	agent.configMutex.Lock()
@@ -57,8 +106,100 @@ func TestAgent_config(t *testing.T) {
 	agent.configMutex.Unlock()
 }
 
+func TestAgent_config_nonBlocking(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer ts.Close()
+
+	fb := &fakeBearer{
+		config:     Config{BlockedDomains: []string{"blocked.example.com"}},
+		configHang: make(chan struct{}),
+	}
+	client := &http.Client{Transport: &Agent{SecretKey: "sk", Transport: fb, OperationalTransport: fb}, Timeout: time.Second}
+
+	start := time.Now()
+	resp, err := client.Get(ts.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.True(t, time.Since(start) < 500*time.Millisecond)
+
+	// blocked domains are enforced once the config is fetched
+	close(fb.configHang)
+	time.Sleep(100 * time.Millisecond)
+	_, err = client.Get("http://blocked.example.com/")
+	assert.True(t, errors.Is(err, ErrBlockedDomain))
+}
+
+func TestAgent_DisableBlocking(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer ts.Close()
+
+	fb := &fakeBearer{config: Config{BlockedDomains: []string{"127.0.0.1"}}}
+	agent := &Agent{Transport: fb, DisableBlocking: true, RefreshConfigEvery: 10 * time.Millisecond}
+	resp, err := (&http.Client{Transport: agent}).Get(ts.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	time.Sleep(50 * time.Millisecond)
+	fb.mutex.Lock()
+	assert.Equal(t, 0, fb.configFetches)
+	fb.mutex.Unlock()
+	assert.Equal(t, 0, agent.Stats().ConfigUpdates)
+}
+
+func TestAgent_config_SingleRefresher(t *testing.T) {
+	fb := &fakeBearer{configHang: make(chan struct{})}
+	agent := &Agent{SecretKey: "sk", Transport: fb, OperationalTransport: fb, RefreshConfigEvery: time.Hour}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// the first fetch is still in progress
+			assert.Nil(t, agent.config())
+		}()
+	}
+	wg.Wait()
+	close(fb.configHang)
+
+	for agent.Stats().ConfigUpdates == 0 {
+		time.Sleep(5 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	fb.mutex.Lock()
+	assert.Equal(t, 1, fb.configFetches)
+	fb.mutex.Unlock()
+	assert.Equal(t, 1, agent.Stats().ConfigUpdates)
+	assert.NotNil(t, agent.config())
+}
+
+func TestAgent_InitialConfig(t *testing.T) {
+	fb := &fakeBearer{config: Config{BlockedDomains: []string{"network.example.com"}}}
+	agent := &Agent{
+		SecretKey:            "sk",
+		Transport:            fb,
+		OperationalTransport: fb,
+		InitialConfig:        &Config{BlockedDomains: []string{"seeded.example.com"}},
+		RefreshConfigEvery:   200 * time.Millisecond,
+	}
+	client := &http.Client{Transport: agent}
+
+	_, err := client.Get("http://seeded.example.com/")
+	assert.True(t, errors.Is(err, ErrBlockedDomain))
+	fb.mutex.Lock()
+	assert.Equal(t, 0, fb.configFetches)
+	fb.mutex.Unlock()
+
+	time.Sleep(300 * time.Millisecond)
+	fb.mutex.Lock()
+	assert.Equal(t, 1, fb.configFetches)
+	fb.mutex.Unlock()
+	_, err = client.Get("http://network.example.com/")
+	assert.True(t, errors.Is(err, ErrBlockedDomain))
+}
+
 func TestAgent_logRecords(t *testing.T) {
-	records := []reportLog{
+	records := []ReportLog{
 		{
 			Protocol:        "https",
 			Path:            "/sample",
@@ -111,6 +252,244 @@ func TestAgent_logRecords(t *testing.T) {
 	})
 }
 
+func TestAgent_logRecords_DeliveryError(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		body     string
+		expected DeliveryError
+		message  string
+	}{
+		{"structured", `{"code":"INVALID_KEY","message":"invalid secret key"}`, DeliveryError{StatusCode: 401, Code: "INVALID_KEY", Message: "invalid secret key"}, "unsupported status code: 401: invalid secret key (INVALID_KEY)"},
+		{"message-only", `{"message":"invalid secret key"}`, DeliveryError{StatusCode: 401, Message: "invalid secret key"}, "unsupported status code: 401: invalid secret key"},
+		{"unparseable", `<html>Unauthorized</html>`, DeliveryError{StatusCode: 401}, "unsupported status code: 401"},
+		{"empty", ``, DeliveryError{StatusCode: 401}, "unsupported status code: 401"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			transport := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				return &http.Response{StatusCode: 401, Body: ioutil.NopCloser(strings.NewReader(test.body))}, nil
+			})
+			agent := &Agent{SecretKey: "invalid", Transport: transport, OperationalTransport: transport}
+			err := agent.logRecords([]ReportLog{{Method: "GET"}})
+			var deliveryErr *DeliveryError
+			require.True(t, errors.As(err, &deliveryErr))
+			assert.Equal(t, test.expected, *deliveryErr)
+			assert.EqualError(t, err, test.message)
+		})
+	}
+}
+
+type failingSink struct{}
+
+func (failingSink) Send(ctx context.Context, records []ReportLog) error {
+	return errors.New("disk full")
+}
+
+func TestAgent_logRecords_Sinks(t *testing.T) {
+	records := []ReportLog{
+		{Method: "GET", Hostname: "api.example.com", Path: "/a", StatusCode: 200},
+		{Method: "GET", Hostname: "api.example.com", Path: "/b", StatusCode: 500},
+	}
+	fb := &fakeBearer{}
+	sinkA, sinkB := &MemorySink{}, &MemorySink{}
+	agent := &Agent{SecretKey: "sk", Transport: fb, OperationalTransport: fb, Sinks: []RecordSink{sinkA, failingSink{}, sinkB}}
+
+	err := agent.logRecords(records)
+	assert.EqualError(t, err, "deliver to sink: disk full")
+	assert.Equal(t, records, sinkA.Records())
+	assert.Equal(t, records, sinkB.Records())
+	assert.Len(t, fb.waitLogs(t, 2), 2)
+
+	// errors of several sinks are aggregated
+	agent.Sinks = []RecordSink{failingSink{}, failingSink{}}
+	err = agent.logRecords(records)
+	assert.EqualError(t, err, "deliver to sink: disk full; deliver to sink: disk full")
+}
+
+func TestAgent_DeliveryObserver(t *testing.T) {
+	var (
+		durations []time.Duration
+		errs      []error
+	)
+	agent := &Agent{
+		SecretKey:            "sk",
+		OperationalTransport: &fakeBearer{},
+		SynchronousDelivery:  true,
+		DeliveryObserver: func(duration time.Duration, err error) {
+			durations = append(durations, duration)
+			errs = append(errs, err)
+		},
+	}
+	agent.sendRecord(ReportLog{Type: RequestEnd})
+	agent.sendRecord(ReportLog{Type: RequestEnd})
+	assert.Len(t, durations, 2)
+	assert.Equal(t, []error{nil, nil}, errs)
+}
+
+func TestAgent_AfterDelivery(t *testing.T) {
+	var (
+		delivered []ReportLog
+		errs      []error
+	)
+	agent := &Agent{
+		SecretKey:            "sk",
+		OperationalTransport: &fakeBearer{},
+		SynchronousDelivery:  true,
+		AfterDelivery: func(records []ReportLog, err error) {
+			delivered = append(delivered, records...)
+			errs = append(errs, err)
+		},
+	}
+	agent.sendRecord(ReportLog{Type: RequestEnd, Path: "/a"})
+	agent.sendRecord(ReportLog{Type: RequestEnd, Path: "/b"})
+	require.Len(t, delivered, 2)
+	assert.Equal(t, "/a", delivered[0].Path)
+	assert.Equal(t, "/b", delivered[1].Path)
+	assert.Equal(t, []error{nil, nil}, errs)
+
+	// failures are reported too, and a panicking hook does not affect the agent
+	agent.OperationalTransport = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return nil, errors.New("unreachable")
+	})
+	agent.AfterDelivery = func(records []ReportLog, err error) {
+		errs = append(errs, err)
+		panic("hook bug")
+	}
+	agent.sendRecord(ReportLog{Type: RequestEnd, Path: "/c"})
+	require.Len(t, errs, 3)
+	assert.Error(t, errs[2])
+	assert.Equal(t, 0, agent.Stats().PendingRecords)
+	assert.Equal(t, 1, agent.Stats().DeliveryErrors)
+}
+
+func TestAgent_UserAgent(t *testing.T) {
+	var userAgents []string
+	transport := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		userAgents = append(userAgents, req.Method+" "+req.Header.Get("User-Agent"))
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(strings.NewReader("{}"))}, nil
+	})
+
+	agent := &Agent{SecretKey: "sk", Transport: transport, OperationalTransport: transport, ServiceName: "billing"}
+	require.NoError(t, agent.logRecords([]ReportLog{{Method: "GET"}}))
+	_, err := agent.Config()
+	require.NoError(t, err)
+	agent.ServiceName = ""
+	require.NoError(t, agent.logRecords([]ReportLog{{Method: "GET"}}))
+
+	assert.Equal(t, []string{
+		"POST bearer-go/" + version + " (billing)",
+		"GET bearer-go/" + version + " (billing)",
+		"POST bearer-go/" + version,
+	}, userAgents)
+}
+
+func TestAgent_Marshaler(t *testing.T) {
+	var (
+		contentType string
+		body        string
+	)
+	transport := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		contentType = req.Header.Get("Content-Type")
+		buf, err := ioutil.ReadAll(req.Body)
+		require.NoError(t, err)
+		body = string(buf)
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(strings.NewReader("{}"))}, nil
+	})
+	marshaler := func(records []ReportLog, meta LogsMetadata) ([]byte, string, error) {
+		paths := []string{}
+		for _, record := range records {
+			paths = append(paths, record.Path)
+		}
+		return []byte(meta.AgentType + ":" + strings.Join(paths, ",")), "text/x-custom", nil
+	}
+	agent := &Agent{SecretKey: "sk", Transport: transport, OperationalTransport: transport, Marshaler: marshaler}
+	require.NoError(t, agent.logRecords([]ReportLog{{Path: "/a"}, {Path: "/b"}}))
+	assert.Equal(t, "text/x-custom", contentType)
+	assert.Equal(t, "bearer-go:/a,/b", body)
+
+	// errors are returned without delivering
+	body = ""
+	agent.Marshaler = func(records []ReportLog, meta LogsMetadata) ([]byte, string, error) {
+		return nil, "", errors.New("boom")
+	}
+	assert.EqualError(t, agent.logRecords([]ReportLog{{Path: "/a"}}), "marshal records: boom")
+	assert.Empty(t, body)
+
+	// the default marshaler encodes JSON
+	agent.Marshaler = nil
+	require.NoError(t, agent.logRecords([]ReportLog{{Path: "/a"}}))
+	assert.Equal(t, "application/json", contentType)
+	assert.Contains(t, body, `"secretKey":"sk"`)
+	assert.Contains(t, body, `"path":"/a"`)
+}
+
+func TestAgent_SchemaVersion(t *testing.T) {
+	var body []byte
+	transport := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		buf, err := ioutil.ReadAll(req.Body)
+		require.NoError(t, err)
+		body = buf
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(strings.NewReader("{}"))}, nil
+	})
+	agent := &Agent{SecretKey: "sk", Transport: transport, OperationalTransport: transport}
+	require.NoError(t, agent.logRecords([]ReportLog{{Path: "/a"}}))
+	var payload struct {
+		SchemaVersion int         `json:"schemaVersion"`
+		SecretKey     string      `json:"secretKey"`
+		Logs          []ReportLog `json:"logs"`
+	}
+	require.NoError(t, json.Unmarshal(body, &payload))
+	assert.Equal(t, DefaultSchemaVersion, payload.SchemaVersion)
+	assert.Equal(t, "sk", payload.SecretKey)
+	require.Len(t, payload.Logs, 1)
+
+	agent.SchemaVersion = SchemaVersion1
+	require.NoError(t, agent.logRecords([]ReportLog{{Path: "/a"}}))
+	assert.Contains(t, string(body), `"schemaVersion":1`)
+
+	// unknown versions are not delivered
+	body = nil
+	agent.SchemaVersion = 42
+	assert.EqualError(t, agent.logRecords([]ReportLog{{Path: "/a"}}), "marshal records: unsupported schema version: 42")
+	assert.Nil(t, body)
+}
+
+func TestAgent_logRecords_DeduplicateBatch(t *testing.T) {
+	record := ReportLog{Method: "GET", Hostname: "api.example.com", Path: "/sample", StatusCode: 200}
+	other := ReportLog{Method: "GET", Hostname: "api.example.com", Path: "/sample", StatusCode: 500}
+
+	fb := &fakeBearer{}
+	agent := &Agent{SecretKey: "sk", Transport: fb, OperationalTransport: fb, DeduplicateBatch: true}
+	require.NoError(t, agent.logRecords([]ReportLog{record, other, record, record}))
+	logs := fb.waitLogs(t, 2)
+	assert.Equal(t, "/sample", logs[0].Path)
+	assert.Equal(t, 200, logs[0].StatusCode)
+	assert.Equal(t, 3, logs[0].Count)
+	assert.Equal(t, 500, logs[1].StatusCode)
+	assert.Equal(t, 1, logs[1].Count)
+}
+
+func TestAgent_DeduplicateBatch(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer ts.Close()
+
+	fb := &fakeBearer{}
+	agent := &Agent{SecretKey: "sk", DisableBlocking: true, Transport: fb, OperationalTransport: fb, DeduplicateBatch: true, flushPeriod: time.Hour}
+	client := &http.Client{Transport: agent}
+	for _, path := range []string{"/sample", "/sample", "/other", "/sample"} {
+		resp, err := client.Get(ts.URL + path)
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+	require.NoError(t, agent.Flush())
+
+	logs := fb.waitLogs(t, 2)
+	assert.Equal(t, "/sample", logs[0].Path)
+	assert.Equal(t, 3, logs[0].Count)
+	assert.Equal(t, "/other", logs[1].Path)
+	assert.Equal(t, 1, logs[1].Count)
+	assert.Equal(t, 4, agent.Stats().RecordsSent)
+}
+
 func TestRoundTrip(t *testing.T) {
 	handler := func(w http.ResponseWriter, req *http.Request) {
 		w.Header().Add("Hello", "World")
@@ -140,6 +519,29 @@ func TestRoundTrip(t *testing.T) {
 		resp, err := client.Get(ts.URL)
 		assert.True(t, errors.Is(err, ErrBlockedDomain))
 		assert.Nil(t, resp)
+		var blockedErr *BlockedDomainError
+		require.True(t, errors.As(err, &blockedErr))
+		assert.Equal(t, "127.0.0.1", blockedErr.Hostname)
+		assert.Equal(t, "127.0.0.1", blockedErr.Pattern)
+	})
+
+	t.Run("blocked-domain/port", func(t *testing.T) {
+		u, err := url.Parse(ts.URL)
+		require.NoError(t, err)
+		client := &http.Client{
+			Transport: &Agent{
+				configCache: &Config{
+					BlockedDomains: []string{u.Host},
+				},
+			},
+		}
+		resp, err := client.Get(ts.URL)
+		assert.True(t, errors.Is(err, ErrBlockedDomain))
+		assert.Nil(t, resp)
+		var blockedErr *BlockedDomainError
+		require.True(t, errors.As(err, &blockedErr))
+		assert.Equal(t, "127.0.0.1", blockedErr.Hostname)
+		assert.Equal(t, u.Host, blockedErr.Pattern)
 	})
 
 	sk := os.Getenv("BEARER_TOKEN")
@@ -156,6 +558,164 @@ func TestRoundTrip(t *testing.T) {
 	})
 }
 
+func TestAgent_Wrap(t *testing.T) {
+	var received http.Header
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		received = req.Header.Clone()
+	}))
+	defer ts.Close()
+
+	var (
+		mutex sync.Mutex
+		inner []string
+	)
+	fb := &fakeBearer{}
+	withHeader := func(key string, next http.RoundTripper) http.RoundTripper {
+		return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			req = req.Clone(req.Context())
+			req.Header.Set(key, "1")
+			return next.RoundTrip(req)
+		})
+	}
+	agent := Init("sk").Wrap(withHeader("X-Inner", roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		mutex.Lock()
+		inner = append(inner, req.URL.Hostname())
+		mutex.Unlock()
+		return fb.RoundTrip(req)
+	})))
+	agent.OperationalTransport = fb
+	client := &http.Client{Transport: withHeader("X-Outer", agent)}
+
+	resp, err := client.Get(ts.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, "1", received.Get("X-Outer"))
+	assert.Equal(t, "1", received.Get("X-Inner"))
+
+	logs := fb.waitLogs(t, 1)
+	assert.Equal(t, "1", logs[0].RequestHeaders["X-Outer"])
+	// the agent's own requests to Bearer do not go through next
+	mutex.Lock()
+	defer mutex.Unlock()
+	assert.Equal(t, []string{"127.0.0.1"}, inner)
+}
+
+func TestAgent_CaptureOutboundRequestHeaders(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer ts.Close()
+
+	fb := &fakeBearer{}
+	withAuth := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		req = req.Clone(req.Context())
+		req.Header.Set("Authorization", "Bearer token")
+		req.Header.Set("X-Inner", "1")
+		return fb.RoundTrip(req)
+	})
+	agent := Init("sk").Wrap(withAuth)
+	agent.OperationalTransport = fb
+	agent.CaptureOutboundRequestHeaders = true
+
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	require.NoError(t, err)
+	req.Header.Set("X-Caller", "1")
+	resp, err := agent.RoundTrip(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	logs := fb.waitLogs(t, 1)
+	assert.Equal(t, "1", logs[0].RequestHeaders["X-Caller"])
+	assert.NotContains(t, logs[0].RequestHeaders, "X-Inner")
+	assert.Equal(t, "1", logs[0].OutboundRequestHeaders["X-Caller"])
+	assert.Equal(t, "1", logs[0].OutboundRequestHeaders["X-Inner"])
+	assert.Equal(t, "[FILTERED]", logs[0].OutboundRequestHeaders["Authorization"])
+}
+
+func TestReplaceGlobals(t *testing.T) {
+	orig := http.DefaultTransport
+	a, b := &Agent{}, &Agent{}
+
+	t.Run("nested", func(t *testing.T) {
+		restoreA := ReplaceGlobals(a)
+		assert.Equal(t, a, http.DefaultTransport)
+		restoreB := ReplaceGlobals(b)
+		assert.Equal(t, b, http.DefaultTransport)
+		restoreB()
+		assert.Equal(t, a, http.DefaultTransport)
+		restoreA()
+		assert.Equal(t, orig, http.DefaultTransport)
+	})
+
+	t.Run("out-of-order", func(t *testing.T) {
+		restoreA := ReplaceGlobals(a)
+		restoreB := ReplaceGlobals(b)
+		restoreA()
+		assert.Equal(t, b, http.DefaultTransport)
+		restoreB()
+		assert.Equal(t, orig, http.DefaultTransport)
+		restoreB()
+		assert.Equal(t, orig, http.DefaultTransport)
+	})
+
+	t.Run("concurrent", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				restore := ReplaceGlobals(&Agent{})
+				restore()
+			}()
+		}
+		wg.Wait()
+		assert.Equal(t, orig, http.DefaultTransport)
+	})
+}
+
+func TestMatchBlockedDomain(t *testing.T) {
+	tests := []struct {
+		blocked  string
+		url      string
+		expected bool
+	}{
+		{"localhost", "http://localhost/", true},
+		{"localhost", "http://localhost:8080/", true},
+		{"LocalHost", "http://localhost/", true},
+		{"localhost:8080", "http://localhost:8080/", true},
+		{"localhost:8080", "http://localhost:8081/", false},
+		{"localhost:8080", "http://localhost/", false},
+		{"localhost:80", "http://localhost/", true},
+		{"example.com:443", "https://example.com/", true},
+		{"example.com", "http://api.example.com/", false},
+		{"::1", "http://[::1]:8080/", true},
+		{"[::1]", "http://[::1]/", true},
+		{"[::1]:8080", "http://[::1]:8080/", true},
+		{"[::1]:8080", "http://[::1]:9090/", false},
+		{"::1", "http://127.0.0.1/", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.blocked+" "+test.url, func(t *testing.T) {
+			u, err := url.Parse(test.url)
+			require.NoError(t, err)
+			_, got := matchBlockedDomain([]string{test.blocked}, u)
+			assert.Equal(t, test.expected, got)
+		})
+	}
+}
+
+func TestRecordType(t *testing.T) {
+	out, err := json.Marshal(ReportLog{Type: RequestEnd})
+	require.NoError(t, err)
+	assert.Contains(t, string(out), `"type":"REQUEST_END"`)
+
+	var record ReportLog
+	require.NoError(t, json.Unmarshal([]byte(`{"type":"REQUEST_ERROR"}`), &record))
+	assert.Equal(t, RequestError, record.Type)
+	assert.True(t, record.Type.Valid())
+	assert.False(t, RecordType("").Valid())
+	assert.False(t, RecordType("request_end").Valid())
+}
+
 func TestIsParseableContentType(t *testing.T) {
 	//isParseableContentType = regexp.MustCompile(`(?i)json|text|xml|x-www-form-urlencoded`)
 	tests := []struct {
@@ -179,3 +739,2423 @@ func TestIsParseableContentType(t *testing.T) {
 		})
 	}
 }
+
+func TestAgent_ExcludePaths(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("ok " + req.URL.Path))
+	}))
+	defer ts.Close()
+
+	fb := &fakeBearer{}
+	client := &http.Client{
+		Transport: &Agent{
+			SecretKey:            "sk",
+			Transport:            fb,
+			OperationalTransport: fb,
+			ExcludePaths:         []string{"/healthz", "/metrics/", "/api/*/status"},
+		},
+	}
+	for _, urlPath := range []string{"/healthz", "/healthz/ready", "/metrics", "/api/v1/status", "/api", "/healthzz", "/api/v1/users"} {
+		resp, err := client.Get(ts.URL + urlPath)
+		require.NoError(t, err)
+		body, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		resp.Body.Close()
+		// excluded requests are still performed
+		assert.Equal(t, "ok "+urlPath, string(body))
+	}
+	logs := fb.waitLogs(t, 3)
+	var paths []string
+	for _, log := range logs {
+		paths = append(paths, log.Path)
+	}
+	assert.ElementsMatch(t, []string{"/api", "/healthzz", "/api/v1/users"}, paths)
+}
+
+func TestAgent_ShouldRecord(t *testing.T) {
+	handler := func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/fail" {
+			w.WriteHeader(500)
+		}
+		w.Write([]byte("hello"))
+	}
+	ts := httptest.NewServer(http.HandlerFunc(handler))
+	defer ts.Close()
+
+	t.Run("5xx-only", func(t *testing.T) {
+		fb := &fakeBearer{}
+		client := &http.Client{
+			Transport: &Agent{
+				SecretKey:            "sk",
+				Transport:            fb,
+				OperationalTransport: fb,
+				ShouldRecord: func(req *http.Request, resp *http.Response) bool {
+					return resp != nil && resp.StatusCode >= 500
+				},
+			},
+		}
+		for _, path := range []string{"/ok", "/fail", "/ok"} {
+			resp, err := client.Get(ts.URL + path)
+			require.NoError(t, err)
+			resp.Body.Close()
+		}
+		logs := fb.waitLogs(t, 1)
+		assert.Equal(t, "/fail", logs[0].Path)
+		assert.Equal(t, 500, logs[0].StatusCode)
+	})
+
+	t.Run("post-only", func(t *testing.T) {
+		fb := &fakeBearer{}
+		client := &http.Client{
+			Transport: &Agent{
+				SecretKey:            "sk",
+				Transport:            fb,
+				OperationalTransport: fb,
+				ShouldRecord: func(req *http.Request, resp *http.Response) bool {
+					return req.Method == "POST"
+				},
+			},
+		}
+		resp, err := client.Get(ts.URL + "/get")
+		require.NoError(t, err)
+		resp.Body.Close()
+		resp, err = client.Post(ts.URL+"/post", "text/plain", nil)
+		require.NoError(t, err)
+		resp.Body.Close()
+		logs := fb.waitLogs(t, 1)
+		assert.Equal(t, "POST", logs[0].Method)
+		assert.Equal(t, "/post", logs[0].Path)
+	})
+}
+
+func TestAgent_ProcessRecord(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/fail" {
+			w.WriteHeader(500)
+		}
+	}))
+	defer ts.Close()
+
+	t.Run("add-tag", func(t *testing.T) {
+		fb := &fakeBearer{}
+		agent := &Agent{
+			SecretKey:            "sk",
+			Transport:            fb,
+			OperationalTransport: fb,
+			ProcessRecord: func(record *ReportLog) bool {
+				record.Tags = map[string]string{"env": "test", "status": fmt.Sprintf("%d", record.StatusCode)}
+				return true
+			},
+		}
+		resp, err := (&http.Client{Transport: agent}).Get(ts.URL)
+		require.NoError(t, err)
+		resp.Body.Close()
+		logs := fb.waitLogs(t, 1)
+		assert.Equal(t, map[string]string{"env": "test", "status": "200"}, logs[0].Tags)
+	})
+
+	t.Run("drop", func(t *testing.T) {
+		fb := &fakeBearer{}
+		agent := &Agent{
+			SecretKey:            "sk",
+			Transport:            fb,
+			OperationalTransport: fb,
+			ProcessRecord: func(record *ReportLog) bool {
+				return record.StatusCode != 500
+			},
+		}
+		client := &http.Client{Transport: agent}
+		for _, path := range []string{"/fail", "/ok", "/fail"} {
+			resp, err := client.Get(ts.URL + path)
+			require.NoError(t, err)
+			resp.Body.Close()
+		}
+		logs := fb.waitLogs(t, 1)
+		assert.Equal(t, "/ok", logs[0].Path)
+	})
+}
+
+func TestRoundTrip_Bytes(t *testing.T) {
+	payload := strings.Repeat("a", 1234)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", req.URL.Query().Get("ct"))
+		if req.URL.Query().Get("chunked") != "" {
+			// flushing before the end of the body makes it chunked, without Content-Length
+			w.Write([]byte(payload[:100]))
+			w.(http.Flusher).Flush()
+			w.Write([]byte(payload[100:]))
+			return
+		}
+		w.Write([]byte(payload))
+	}))
+	defer ts.Close()
+
+	// text/plain bodies are captured, binary ones are not
+	for _, test := range []struct {
+		contentType string
+		chunked     bool
+	}{
+		{contentType: "text/plain"},
+		{contentType: "application/octet-stream"},
+		{contentType: "text/plain", chunked: true},
+		{contentType: "application/octet-stream", chunked: true},
+	} {
+		contentType := test.contentType
+		t.Run(fmt.Sprintf("%s chunked=%t", contentType, test.chunked), func(t *testing.T) {
+			fb := &fakeBearer{}
+			agent := &Agent{SecretKey: "sk", Transport: fb, OperationalTransport: fb, SynchronousDelivery: true}
+			target := ts.URL + "?ct=" + contentType
+			if test.chunked {
+				target += "&chunked=1"
+			}
+			resp, err := (&http.Client{Transport: agent}).Post(target, contentType, strings.NewReader("hello world"))
+			require.NoError(t, err)
+			if test.chunked {
+				assert.Equal(t, int64(-1), resp.ContentLength)
+			}
+			body, err := ioutil.ReadAll(resp.Body)
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, payload, string(body))
+
+			logs := fb.waitLogs(t, 1)
+			assert.Equal(t, 11, logs[0].BytesSent)
+			assert.Equal(t, 1234, logs[0].BytesReceived)
+		})
+	}
+}
+
+func TestRoundTrip_UnclosedBody(t *testing.T) {
+	next := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		resp := fakeResponse(req, 200, "hello")
+		resp.Header.Set("Content-Type", "application/octet-stream")
+		resp.ContentLength = -1
+		return resp, nil
+	})
+	fb := &fakeBearer{}
+	agent := &Agent{SecretKey: "sk", Transport: next, OperationalTransport: fb, SynchronousDelivery: true, bodyTimeout: 10 * time.Millisecond}
+	req, err := http.NewRequest("GET", "http://api.example.com/unclosed", nil)
+	require.NoError(t, err)
+	resp, err := agent.RoundTrip(req)
+	require.NoError(t, err)
+	// the body is partially read, and neither read to the end nor closed
+	_, err = resp.Body.Read(make([]byte, 2))
+	require.NoError(t, err)
+
+	logs := fb.waitLogs(t, 1)
+	assert.Equal(t, "/unclosed", logs[0].Path)
+	assert.Equal(t, 2, logs[0].BytesReceived)
+}
+
+func TestRoundTrip_DryRun(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer ts.Close()
+
+	core, observed := observer.New(zap.InfoLevel)
+	fb := &fakeBearer{}
+	agent := &Agent{SecretKey: "sk", Transport: fb, OperationalTransport: fb, DryRun: true, Logger: zap.New(core)}
+	req, err := http.NewRequest("GET", ts.URL+"/dry", nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "secret")
+	resp, err := (&http.Client{Transport: agent}).Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	entries := observed.FilterMessageSnippet("dry run").All()
+	require.Len(t, entries, 1)
+	var record ReportLog
+	require.NoError(t, json.Unmarshal([]byte(entries[0].ContextMap()["record"].(string)), &record))
+	assert.Equal(t, "/dry", record.Path)
+	assert.Equal(t, "[FILTERED]", record.RequestHeaders["Authorization"])
+
+	fb.waitLogs(t, 0)
+	assert.Equal(t, 0, agent.Stats().RecordsSent)
+}
+
+func TestRoundTrip_SynchronousDelivery(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer ts.Close()
+
+	fb := &fakeBearer{}
+	client := &http.Client{Transport: &Agent{SecretKey: "sk", Transport: fb, OperationalTransport: fb, SynchronousDelivery: true}}
+	resp, err := client.Get(ts.URL + "/sync")
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	fb.mutex.Lock()
+	defer fb.mutex.Unlock()
+	require.Len(t, fb.logs, 1)
+	assert.Equal(t, "/sync", fb.logs[0].Path)
+}
+
+// fakeClock is a Clock advancing by step on each call to Now.
+type fakeClock struct {
+	mutex sync.Mutex
+	now   time.Time
+	step  time.Duration
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	now := c.now
+	c.now = c.now.Add(c.step)
+	return now
+}
+
+func TestRoundTrip_Clock(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer ts.Close()
+
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	fb := &fakeBearer{}
+	agent := &Agent{
+		SecretKey:            "sk",
+		Transport:            fb,
+		OperationalTransport: fb,
+		SynchronousDelivery:  true,
+		Clock:                &fakeClock{now: start, step: 250 * time.Millisecond},
+	}
+	resp, err := (&http.Client{Transport: agent}).Get(ts.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	logs := fb.waitLogs(t, 1)
+	assert.Equal(t, int(start.UnixNano()/1000000), logs[0].StartedAt)
+	assert.Equal(t, int(start.UnixNano()/1000000)+250, logs[0].EndedAt)
+}
+
+func TestRoundTrip_LatencyBucket(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer ts.Close()
+
+	for _, test := range []struct {
+		step     time.Duration
+		expected string
+	}{
+		{50 * time.Millisecond, "0s-100ms"},
+		{100 * time.Millisecond, "100ms-1s"},
+		{999 * time.Millisecond, "100ms-1s"},
+		{3 * time.Second, "1s+"},
+	} {
+		t.Run(test.step.String(), func(t *testing.T) {
+			fb := &fakeBearer{}
+			agent := &Agent{
+				SecretKey:            "sk",
+				Transport:            fb,
+				OperationalTransport: fb,
+				SynchronousDelivery:  true,
+				Clock:                &fakeClock{now: time.Now(), step: test.step},
+				LatencyThresholds:    []time.Duration{100 * time.Millisecond, time.Second},
+			}
+			resp, err := (&http.Client{Transport: agent}).Get(ts.URL)
+			require.NoError(t, err)
+			resp.Body.Close()
+
+			logs := fb.waitLogs(t, 1)
+			assert.Equal(t, test.expected, logs[0].LatencyBucket)
+		})
+	}
+
+	resp := &http.Response{StatusCode: 200, Header: http.Header{}}
+	record := (&Agent{}).newRecord(httptest.NewRequest("GET", "/", nil), resp, time.Now(), time.Now(), nil, nil)
+	assert.Empty(t, record.LatencyBucket)
+}
+
+func TestRoundTrip_TLS(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {})
+
+	t.Run("tls", func(t *testing.T) {
+		ts := httptest.NewTLSServer(handler)
+		defer ts.Close()
+		fb := &fakeBearer{next: ts.Client().Transport}
+		agent := &Agent{SecretKey: "sk", Transport: fb, OperationalTransport: fb, SynchronousDelivery: true}
+		resp, err := (&http.Client{Transport: agent}).Get(ts.URL)
+		require.NoError(t, err)
+		resp.Body.Close()
+
+		logs := fb.waitLogs(t, 1)
+		assert.Equal(t, "TLS 1.3", logs[0].TLSVersion)
+		assert.Equal(t, tls.CipherSuiteName(resp.TLS.CipherSuite), logs[0].CipherSuite)
+		assert.NotEmpty(t, logs[0].CipherSuite)
+	})
+
+	t.Run("plaintext", func(t *testing.T) {
+		ts := httptest.NewServer(handler)
+		defer ts.Close()
+		fb := &fakeBearer{}
+		agent := &Agent{SecretKey: "sk", Transport: fb, OperationalTransport: fb, SynchronousDelivery: true}
+		resp, err := (&http.Client{Transport: agent}).Get(ts.URL)
+		require.NoError(t, err)
+		resp.Body.Close()
+
+		logs := fb.waitLogs(t, 1)
+		assert.Empty(t, logs[0].TLSVersion)
+		assert.Empty(t, logs[0].CipherSuite)
+	})
+}
+
+func TestRoundTrip_CaptureAddrs(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	require.NoError(t, err)
+
+	fb := &fakeBearer{}
+	agent := &Agent{SecretKey: "sk", Transport: fb, OperationalTransport: fb, SynchronousDelivery: true, CaptureAddrs: true}
+	client := &http.Client{Transport: agent}
+	for i := 0; i < 2; i++ { // the second request reuses the connection
+		resp, err := client.Get(ts.URL)
+		require.NoError(t, err)
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+
+	logs := fb.waitLogs(t, 2)
+	for _, log := range logs {
+		assert.Equal(t, u.Host, log.RemoteAddr)
+		assert.NotEmpty(t, log.LocalAddr)
+	}
+
+	// no connection, no addresses
+	fb = &fakeBearer{}
+	agent = &Agent{SecretKey: "sk", Transport: fb, OperationalTransport: fb, SynchronousDelivery: true, CaptureAddrs: true}
+	closed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	closed.Close()
+	_, err = (&http.Client{Transport: agent}).Get(closed.URL)
+	require.Error(t, err)
+	logs = fb.waitLogs(t, 1)
+	assert.Empty(t, logs[0].RemoteAddr)
+	assert.Empty(t, logs[0].LocalAddr)
+}
+
+func TestRoundTrip_CorrelationID(t *testing.T) {
+	var (
+		mutex    sync.Mutex
+		received []string
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		received = append(received, req.Header.Get("X-Correlation-Id"))
+	}))
+	defer ts.Close()
+
+	fb := &fakeBearer{}
+	agent := &Agent{SecretKey: "sk", Transport: fb, OperationalTransport: fb, SynchronousDelivery: true, CorrelationIDHeader: "X-Correlation-Id"}
+	client := &http.Client{Transport: agent}
+	for i := 0; i < 3; i++ {
+		req, err := http.NewRequest("GET", ts.URL, nil)
+		require.NoError(t, err)
+		if i == 2 {
+			req.Header.Set("X-Correlation-Id", "existing")
+		}
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		// the caller's request is not modified
+		if i < 2 {
+			assert.Empty(t, req.Header.Get("X-Correlation-Id"))
+		}
+	}
+
+	logs := fb.waitLogs(t, 3)
+	assert.Regexp(t, `^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`, logs[0].CorrelationID)
+	assert.NotEqual(t, logs[0].CorrelationID, logs[1].CorrelationID)
+	assert.Equal(t, "existing", logs[2].CorrelationID)
+	mutex.Lock()
+	assert.Equal(t, []string{logs[0].CorrelationID, logs[1].CorrelationID, "existing"}, received)
+	mutex.Unlock()
+
+	// without header, no ID is generated
+	fb = &fakeBearer{}
+	agent = &Agent{SecretKey: "sk", Transport: fb, OperationalTransport: fb, SynchronousDelivery: true}
+	resp, err := (&http.Client{Transport: agent}).Get(ts.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	logs = fb.waitLogs(t, 1)
+	assert.Empty(t, logs[0].CorrelationID)
+	mutex.Lock()
+	defer mutex.Unlock()
+	assert.Empty(t, received[3])
+}
+
+func TestRoundTrip_CaptureDNS(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	require.NoError(t, err)
+	u.Host = "localhost:" + u.Port()
+
+	fb := &fakeBearer{next: &http.Transport{}}
+	agent := &Agent{SecretKey: "sk", Transport: fb, OperationalTransport: fb, SynchronousDelivery: true, CaptureDNS: true}
+	client := &http.Client{Transport: agent}
+	for i := 0; i < 2; i++ { // the second request reuses the connection
+		resp, err := client.Get(u.String())
+		require.NoError(t, err)
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+
+	logs := fb.waitLogs(t, 2)
+	assert.Contains(t, logs[0].ResolvedIPs, "127.0.0.1")
+	assert.Empty(t, logs[1].ResolvedIPs)
+	assert.Empty(t, logs[0].DNSError)
+	// addresses are not recorded unless CaptureAddrs is set
+	assert.Empty(t, logs[0].RemoteAddr)
+
+	// failed lookup
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return nil, errors.New("no DNS server")
+		},
+	}
+	fb = &fakeBearer{next: &http.Transport{DialContext: (&net.Dialer{Resolver: resolver}).DialContext}}
+	agent = &Agent{SecretKey: "sk", Transport: fb, OperationalTransport: fb, SynchronousDelivery: true, CaptureDNS: true}
+	_, err = (&http.Client{Transport: agent}).Get("http://api.example.invalid/")
+	require.Error(t, err)
+	logs = fb.waitLogs(t, 1)
+	assert.Empty(t, logs[0].ResolvedIPs)
+	assert.Contains(t, logs[0].DNSError, "no DNS server")
+}
+
+func TestRoundTrip_CaptureTimings(t *testing.T) {
+	for _, contentType := range []string{"text/plain", "application/octet-stream"} {
+		t.Run(contentType, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				w.Header().Set("Content-Type", contentType)
+				w.WriteHeader(200)
+				w.(http.Flusher).Flush()
+				time.Sleep(100 * time.Millisecond)
+				w.Write([]byte("hello"))
+			}))
+			defer ts.Close()
+
+			fb := &fakeBearer{}
+			agent := &Agent{SecretKey: "sk", Transport: fb, OperationalTransport: fb, CaptureTimings: true}
+			resp, err := (&http.Client{Transport: agent}).Get(ts.URL)
+			require.NoError(t, err)
+			body, err := ioutil.ReadAll(resp.Body)
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, "hello", string(body))
+
+			logs := fb.waitLogs(t, 1)
+			assert.True(t, logs[0].TimeToFirstByte <= logs[0].EndedAt-logs[0].StartedAt)
+			assert.True(t, logs[0].TimeToFirstByte < 100, "TTFB of %dms", logs[0].TimeToFirstByte)
+			assert.True(t, logs[0].BodyReadTime >= 90, "body read in %dms", logs[0].BodyReadTime)
+		})
+	}
+
+	// no response, no timings
+	fb := &fakeBearer{}
+	agent := &Agent{SecretKey: "sk", Transport: fb, OperationalTransport: fb, CaptureTimings: true, SynchronousDelivery: true}
+	closed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	closed.Close()
+	_, err := (&http.Client{Transport: agent}).Get(closed.URL)
+	require.Error(t, err)
+	logs := fb.waitLogs(t, 1)
+	assert.Zero(t, logs[0].TimeToFirstByte)
+	assert.Zero(t, logs[0].BodyReadTime)
+}
+
+func TestRoundTrip_ProtoVersion(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {})
+
+	for _, http2 := range []bool{true, false} {
+		t.Run(fmt.Sprintf("http2=%v", http2), func(t *testing.T) {
+			ts := httptest.NewUnstartedServer(handler)
+			ts.EnableHTTP2 = http2
+			ts.StartTLS()
+			defer ts.Close()
+
+			fb := &fakeBearer{next: ts.Client().Transport}
+			agent := &Agent{SecretKey: "sk", Transport: fb, OperationalTransport: fb, SynchronousDelivery: true}
+			resp, err := (&http.Client{Transport: agent}).Get(ts.URL)
+			require.NoError(t, err)
+			resp.Body.Close()
+
+			logs := fb.waitLogs(t, 1)
+			assert.Equal(t, "https", logs[0].Protocol)
+			if http2 {
+				assert.Equal(t, "HTTP/2.0", logs[0].ProtoVersion)
+			} else {
+				assert.Equal(t, "HTTP/1.1", logs[0].ProtoVersion)
+			}
+		})
+	}
+
+	// no response, no protocol version
+	fb := &fakeBearer{}
+	agent := &Agent{SecretKey: "sk", Transport: fb, OperationalTransport: fb, SynchronousDelivery: true}
+	_, err := (&http.Client{Transport: agent}).Get("http://127.0.0.1:1/")
+	require.Error(t, err)
+	logs := fb.waitLogs(t, 1)
+	assert.Empty(t, logs[0].ProtoVersion)
+}
+
+func TestRoundTrip_gRPC(t *testing.T) {
+	handler := func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Write([]byte{0, 0, 0, 0, 2, 0x0a, 0x00})
+		w.Header().Set("Grpc-Status", "5")
+	}
+	ts := httptest.NewServer(http.HandlerFunc(handler))
+	defer ts.Close()
+
+	fb := &fakeBearer{}
+	client := &http.Client{Transport: &Agent{SecretKey: "sk", Transport: fb, OperationalTransport: fb}}
+	req, err := http.NewRequest("POST", ts.URL+"/helloworld.Greeter/SayHello", strings.NewReader("\x00\x00\x00\x00\x02\x0a\x00"))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/grpc")
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Len(t, body, 7)
+	require.NoError(t, resp.Body.Close())
+
+	logs := fb.waitLogs(t, 1)
+	assert.Equal(t, "/helloworld.Greeter/SayHello", logs[0].GRPCMethod)
+	assert.Equal(t, 5, logs[0].StatusCode)
+	assert.Equal(t, 7, logs[0].BytesSent)
+	assert.Equal(t, 7, logs[0].BytesReceived)
+	assert.Empty(t, logs[0].RequestBody)
+	assert.Empty(t, logs[0].ResponseBody)
+}
+
+func TestRoundTrip_gRPCStreaming(t *testing.T) {
+	message := []byte{0, 0, 0, 0, 2, 0x0a, 0x00}
+	drained := make(chan struct{})
+	next := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		// the server answers the first message while the client is still streaming
+		if _, err := io.ReadFull(req.Body, make([]byte, len(message))); err != nil {
+			return nil, err
+		}
+		go func() {
+			io.Copy(ioutil.Discard, req.Body)
+			close(drained)
+		}()
+		resp := fakeResponse(req, 200, string(message))
+		resp.Header.Set("Content-Type", "application/grpc")
+		resp.Trailer = http.Header{"Grpc-Status": {"0"}}
+		return resp, nil
+	})
+
+	fb := &fakeBearer{}
+	agent := &Agent{SecretKey: "sk", Transport: next, OperationalTransport: fb}
+	reader, writer := io.Pipe()
+	go writer.Write(message)
+	req, err := http.NewRequest("POST", "http://api.example.com/helloworld.Greeter/SayHello", reader)
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/grpc")
+
+	responses := make(chan *http.Response, 1)
+	go func() {
+		resp, err := agent.RoundTrip(req)
+		assert.NoError(t, err)
+		responses <- resp
+	}()
+	var resp *http.Response
+	select {
+	case resp = <-responses:
+	case <-time.After(2 * time.Second):
+		writer.Close()
+		t.Fatal("the request body was read before the round trip")
+	}
+
+	_, err = writer.Write(message)
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+	<-drained
+	_, err = ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+
+	logs := fb.waitLogs(t, 1)
+	assert.Equal(t, 14, logs[0].BytesSent)
+	assert.Equal(t, 7, logs[0].BytesReceived)
+}
+
+func TestRoundTrip_Disabled(t *testing.T) {
+	resp := &http.Response{StatusCode: 200}
+	next := roundTripperFunc(func(*http.Request) (*http.Response, error) { return resp, nil })
+	req, err := http.NewRequest("POST", "http://api.example.com/sample", strings.NewReader("hello"))
+	require.NoError(t, err)
+
+	agent := &Agent{SecretKey: "sk", Disabled: true, Transport: next}
+	got, err := agent.RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, resp, got)
+	assert.Nil(t, agent.configCache)
+	assert.Equal(t, 0, agent.configUpdates)
+
+	allocs := testing.AllocsPerRun(100, func() {
+		_, _ = agent.RoundTrip(req)
+	})
+	assert.Equal(t, float64(0), allocs)
+}
+
+func BenchmarkRoundTrip_Disabled(b *testing.B) {
+	resp := &http.Response{StatusCode: 200}
+	next := roundTripperFunc(func(*http.Request) (*http.Response, error) { return resp, nil })
+	req, _ := http.NewRequest("GET", "http://api.example.com/sample", nil)
+	agent := &Agent{SecretKey: "sk", Disabled: true, Transport: next}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _ = agent.RoundTrip(req)
+	}
+}
+
+func BenchmarkRoundTrip_Bodies(b *testing.B) {
+	body := `{"items":[` + strings.Repeat(`{"name":"item","price":42},`, 600) + `{}]}`
+	next := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return fakeResponse(req, 200, body), nil
+	})
+	for _, pool := range []bool{false, true} {
+		b.Run(fmt.Sprintf("PoolBuffers=%v", pool), func(b *testing.B) {
+			agent := &Agent{
+				SecretKey:       "sk",
+				Transport:       next,
+				DisableBlocking: true,
+				PoolBuffers:     pool,
+				// only the buffering of bodies is measured: records are not sanitized, then dropped
+				Hosts:         map[string]HostSettings{"api.example.com": {DisableSanitization: true}},
+				ProcessRecord: func(*ReportLog) bool { return false },
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				req, _ := http.NewRequest("POST", "http://api.example.com/items", strings.NewReader(body))
+				req.Header.Set("Content-Type", "application/json")
+				resp, err := agent.RoundTrip(req)
+				if err != nil {
+					b.Fatal(err)
+				}
+				resp.Body.Close()
+			}
+		})
+	}
+}
+
+func TestAgent_PoolBuffers(t *testing.T) {
+	fb := &fakeBearer{next: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		return fakeResponse(req, 200, string(body)), nil
+	})}
+	agent := &Agent{SecretKey: "sk", Transport: fb, OperationalTransport: fb, PoolBuffers: true}
+
+	const n = 50
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// bodies of different sizes, so that pooled buffers are reused with leftovers of larger ones
+			body := fmt.Sprintf(`{"id":%d,"password":"secret","padding":"%s"}`, i, strings.Repeat("x", i*100))
+			req, err := http.NewRequest("POST", "http://api.example.com/echo", strings.NewReader(body))
+			require.NoError(t, err)
+			req.Header.Set("Content-Type", "application/json")
+			resp, err := agent.RoundTrip(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			got, err := ioutil.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, body, string(got))
+		}(i)
+	}
+	wg.Wait()
+
+	logs := fb.waitLogs(t, n)
+	seen := map[string]bool{}
+	for _, log := range logs {
+		var body struct {
+			ID       int
+			Password string
+			Padding  string
+		}
+		require.NoError(t, json.Unmarshal([]byte(log.RequestBody), &body), log.RequestBody)
+		assert.Equal(t, "[FILTERED]", body.Password)
+		assert.Equal(t, strings.Repeat("x", body.ID*100), body.Padding)
+		assert.Equal(t, log.RequestBody, log.ResponseBody)
+		seen[log.RequestBody] = true
+	}
+	assert.Len(t, seen, n)
+}
+
+func TestReadBody_Pooled(t *testing.T) {
+	first, err := readBody(strings.NewReader("first body"), true)
+	require.NoError(t, err)
+	second, err := readBody(strings.NewReader("second"), true)
+	require.NoError(t, err)
+	empty, err := readBody(strings.NewReader(""), true)
+	require.NoError(t, err)
+
+	// the returned bodies do not share the pooled buffer
+	assert.Equal(t, "first body", string(first))
+	assert.Equal(t, "second", string(second))
+	assert.NotNil(t, empty)
+	assert.Empty(t, empty)
+
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	writer.Write([]byte(`{"user":"bob"}`))
+	require.NoError(t, writer.Close())
+	decoded, err := decodeBodyString(compressed.Bytes(), "gzip", true)
+	require.NoError(t, err)
+	_, err = readBody(strings.NewReader(strings.Repeat("y", 100)), true)
+	require.NoError(t, err)
+	assert.Equal(t, `{"user":"bob"}`, decoded)
+}
+
+func TestAgent_newRecord_gzip(t *testing.T) {
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	writer.Write([]byte(`{"password":"hunter2","user":"bob"}`))
+	require.NoError(t, writer.Close())
+
+	req, err := http.NewRequest("POST", "http://api.example.com/login", nil)
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	resp := &http.Response{
+		StatusCode: 200,
+		Header:     http.Header{"Content-Type": {"application/json"}, "Content-Encoding": {"gzip"}},
+		Body:       ioutil.NopCloser(bytes.NewReader(compressed.Bytes())),
+	}
+
+	agent := &Agent{}
+	record := agent.newRecord(req, resp, time.Now(), time.Now(), nil, nil)
+	assert.Equal(t, `{"password":"[FILTERED]","user":"bob"}`, record.ResponseBody)
+
+	// the caller still receives the original compressed stream
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, compressed.Bytes(), body)
+
+	// invalid gzip data is not recorded
+	resp.Body = ioutil.NopCloser(strings.NewReader("not gzip"))
+	record = agent.newRecord(req, resp, time.Now(), time.Now(), nil, nil)
+	assert.Empty(t, record.ResponseBody)
+	body, err = ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "not gzip", string(body))
+}
+
+func TestAgent_newRecord_CaptureHeaders(t *testing.T) {
+	req, err := http.NewRequest("GET", "http://api.example.com/sample", nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", "test")
+	req.Header.Set("X-Custom", "hello")
+	resp := &http.Response{StatusCode: 200, Header: http.Header{"Content-Type": {"text/plain"}, "X-Custom": {"world"}}}
+
+	agent := &Agent{
+		CaptureRequestHeaders:  []string{"accept", "USER-AGENT"},
+		CaptureResponseHeaders: []string{"Content-Type"},
+	}
+	record := agent.newRecord(req, resp, time.Now(), time.Now(), nil, nil)
+	assert.Equal(t, map[string]string{"Accept": "application/json", "User-Agent": "test"}, record.RequestHeaders)
+	assert.Equal(t, map[string]string{"Content-Type": "text/plain"}, record.ResponseHeaders)
+
+	agent = &Agent{}
+	record = agent.newRecord(req, resp, time.Now(), time.Now(), nil, nil)
+	assert.Len(t, record.RequestHeaders, 3)
+	assert.Len(t, record.ResponseHeaders, 2)
+}
+
+func TestAgent_newRecord_DropHeaders(t *testing.T) {
+	req, err := http.NewRequest("GET", "http://api.example.com/sample", nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("X-Amz-Security-Token", "secret")
+	req.Header.Set("Authorization", "secret")
+	resp := &http.Response{StatusCode: 200, Header: http.Header{"X-Amz-Security-Token": {"secret"}}}
+
+	agent := &Agent{DropHeaders: []string{"x-amz-security-token"}}
+	record := agent.newRecord(req, resp, time.Now(), time.Now(), nil, nil)
+	assert.Equal(t, map[string]string{"Accept": "application/json", "Authorization": "[FILTERED]"}, record.RequestHeaders)
+	assert.NotContains(t, record.ResponseHeaders, "X-Amz-Security-Token")
+}
+
+func TestAgent_newRecord_CaptureBodiesOnErrorOnly(t *testing.T) {
+	agent := &Agent{CaptureBodiesOnErrorOnly: true}
+	for _, test := range []struct {
+		statusCode int
+		captured   bool
+	}{
+		{200, false},
+		{302, false},
+		{404, true},
+		{500, true},
+	} {
+		t.Run(fmt.Sprintf("%d", test.statusCode), func(t *testing.T) {
+			req, err := http.NewRequest("POST", "http://api.example.com/sample", nil)
+			require.NoError(t, err)
+			req.Header.Set("Content-Type", "application/json")
+			resp := &http.Response{
+				StatusCode: test.statusCode,
+				Header:     http.Header{"Content-Type": {"application/json"}},
+				Body:       ioutil.NopCloser(strings.NewReader(`{"ok":false}`)),
+			}
+			record := agent.newRecord(req, resp, time.Now(), time.Now(), []byte(`{"hello":"world"}`), nil)
+			assert.Equal(t, test.statusCode, record.StatusCode)
+			assert.NotEmpty(t, record.RequestHeaders)
+			if test.captured {
+				assert.Equal(t, `{"ok":false}`, record.ResponseBody)
+				assert.Equal(t, `{"hello":"world"}`, record.RequestBody)
+			} else {
+				assert.Empty(t, record.ResponseBody)
+				assert.Empty(t, record.RequestBody)
+			}
+		})
+	}
+}
+
+func TestAgent_newRecord_TextBody(t *testing.T) {
+	req, err := http.NewRequest("POST", "http://api.example.com/sample", nil)
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "text/plain")
+	resp := &http.Response{
+		StatusCode: 200,
+		Header:     http.Header{"Content-Type": {"application/octet-stream"}},
+		Body:       ioutil.NopCloser(strings.NewReader("binary")),
+	}
+
+	agent := &Agent{}
+	record := agent.newRecord(req, resp, time.Now(), time.Now(), []byte("please contact john@example.com"), nil)
+	assert.Equal(t, "please contact [FILTERED]", record.RequestBody)
+	assert.Empty(t, record.ResponseBody)
+}
+
+func TestAgent_newRecord_QueryParams(t *testing.T) {
+	req, err := http.NewRequest("GET", "http://api.example.com/search?q=shoes&page=2&page=3&api_key=secret&contact=john@example.com", nil)
+	require.NoError(t, err)
+
+	agent := &Agent{}
+	record := agent.newRecord(req, &http.Response{StatusCode: 200}, time.Now(), time.Now(), nil, nil)
+	assert.Equal(t, map[string]string{
+		"q":       "shoes",
+		"page":    "2",
+		"api_key": "[FILTERED]",
+		"contact": "[FILTERED]",
+	}, record.QueryParams)
+	u, err := url.Parse(record.URL)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"2", "3"}, u.Query()["page"])
+	assert.Equal(t, "[FILTERED]", u.Query().Get("api_key"))
+
+	req, err = http.NewRequest("GET", "http://api.example.com/search", nil)
+	require.NoError(t, err)
+	record = agent.newRecord(req, &http.Response{StatusCode: 200}, time.Now(), time.Now(), nil, nil)
+	assert.Nil(t, record.QueryParams)
+}
+
+func TestAgent_newRecord_MaxHeaders(t *testing.T) {
+	req, err := http.NewRequest("GET", "http://api.example.com/sample", nil)
+	require.NoError(t, err)
+	resp := &http.Response{StatusCode: 200, Header: http.Header{}}
+	for i := 0; i < 100; i++ {
+		resp.Header.Set(fmt.Sprintf("X-Header-%03d", i), "value")
+	}
+	req.Header.Set("Accept", "*/*")
+
+	agent := &Agent{MaxHeaders: 10}
+	record := agent.newRecord(req, resp, time.Now(), time.Now(), nil, nil)
+	assert.Len(t, record.ResponseHeaders, 10)
+	assert.Contains(t, record.ResponseHeaders, "X-Header-000")
+	assert.Contains(t, record.ResponseHeaders, "X-Header-009")
+	assert.Equal(t, 90, record.TruncatedResponseHeaders)
+	assert.Len(t, record.RequestHeaders, 1)
+	assert.Equal(t, 0, record.TruncatedRequestHeaders)
+
+	agent = &Agent{}
+	record = agent.newRecord(req, resp, time.Now(), time.Now(), nil, nil)
+	assert.Len(t, record.ResponseHeaders, 100)
+	assert.Equal(t, 0, record.TruncatedResponseHeaders)
+}
+
+func TestAgent_newRecord_MetadataOnly(t *testing.T) {
+	req, err := http.NewRequest("POST", "http://api.example.com/sample?token=secret", nil)
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "secret")
+	resp := &http.Response{
+		StatusCode: 201,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       ioutil.NopCloser(strings.NewReader(`{"ok":true}`)),
+	}
+	start := time.Now()
+	end := start.Add(80 * time.Millisecond)
+
+	agent := &Agent{MetadataOnly: true}
+	record := agent.newRecord(req, resp, start, end, []byte(`{"password":"secret"}`), nil)
+	assert.Empty(t, record.RequestHeaders)
+	assert.Empty(t, record.ResponseHeaders)
+	assert.Empty(t, record.RequestBody)
+	assert.Empty(t, record.ResponseBody)
+	assert.Empty(t, record.QueryParams)
+	assert.Equal(t, "http://api.example.com/sample", record.URL)
+	assert.Equal(t, "POST", record.Method)
+	assert.Equal(t, "api.example.com", record.Hostname)
+	assert.Equal(t, "/sample", record.Path)
+	assert.Equal(t, 201, record.StatusCode)
+	assert.Equal(t, 80, record.EndedAt-record.StartedAt)
+
+	// the path and the tags are still sanitized
+	req, err = http.NewRequest("GET", "http://api.example.com/users/john.doe@example.com/tok_live_123", nil)
+	require.NoError(t, err)
+	agent = &Agent{
+		MetadataOnly:  true,
+		SecretStrings: []string{"tok_live_123"},
+		Profiles:      []string{"gdpr"},
+		StaticTags:    map[string]string{"api_key": "secret", "region": "eu-west-1"},
+	}
+	record = agent.newRecord(req, resp, start, end, nil, nil)
+	assert.Equal(t, "/users/[FILTERED]/[FILTERED]", record.Path)
+	assert.NotContains(t, record.URL, "john.doe")
+	assert.NotContains(t, record.URL, "tok_live_123")
+	assert.Equal(t, map[string]string{"api_key": "[FILTERED]", "region": "eu-west-1"}, record.Tags)
+}
+
+func TestAgent_WithOptions(t *testing.T) {
+	logger := zap.NewNop()
+	base := &Agent{SecretKey: "sk", Logger: logger, SampleRate: 0.5, DropHeaders: []string{"X-Secret"}}
+	base.updateStats(func(stats *Stats) { stats.RecordsSent = 42 })
+
+	low := base.WithOptions(func(a *Agent) { a.SampleRate = 0.1 })
+	high := base.WithOptions(func(a *Agent) { a.SampleRate = 1 }, func(a *Agent) { a.DryRun = true })
+
+	assert.Equal(t, 0.5, base.SampleRate)
+	assert.False(t, base.DryRun)
+	assert.Equal(t, 0.1, low.SampleRate)
+	assert.False(t, low.DryRun)
+	assert.Equal(t, float64(1), high.SampleRate)
+	assert.True(t, high.DryRun)
+	for _, variant := range []*Agent{low, high} {
+		assert.Equal(t, "sk", variant.SecretKey)
+		assert.Same(t, logger, variant.Logger)
+		assert.Equal(t, []string{"X-Secret"}, variant.DropHeaders)
+		assert.Equal(t, Stats{}, variant.Stats())
+	}
+
+	low.updateStats(func(stats *Stats) { stats.RecordsSent++ })
+	assert.Equal(t, 42, base.Stats().RecordsSent)
+	assert.Equal(t, 0, high.Stats().RecordsSent)
+}
+
+func TestAgent_newRecord_RequestID(t *testing.T) {
+	req, err := http.NewRequest("GET", "http://api.example.com/sample", nil)
+	require.NoError(t, err)
+	resp := &http.Response{StatusCode: 200, Header: http.Header{"X-Request-Id": {"abc-123"}}}
+
+	agent := &Agent{}
+	record := agent.newRecord(req, resp, time.Now(), time.Now(), nil, nil)
+	assert.Equal(t, "abc-123", record.RequestID)
+
+	// falls back on the request
+	req.Header.Set("X-Amzn-RequestId", "req-456")
+	record = agent.newRecord(req, &http.Response{StatusCode: 200, Header: http.Header{}}, time.Now(), time.Now(), nil, nil)
+	assert.Equal(t, "req-456", record.RequestID)
+
+	// custom headers
+	agent = &Agent{RequestIDHeaders: []string{"X-Correlation-Id"}}
+	record = agent.newRecord(req, resp, time.Now(), time.Now(), nil, nil)
+	assert.Empty(t, record.RequestID)
+	resp.Header.Set("X-Correlation-Id", "corr-789")
+	record = agent.newRecord(req, resp, time.Now(), time.Now(), nil, nil)
+	assert.Equal(t, "corr-789", record.RequestID)
+}
+
+func TestAgent_operationalTransport(t *testing.T) {
+	agentA := &Agent{}
+	agentB := &Agent{OperationalMaxIdleConns: 5, OperationalIdleConnTimeout: time.Minute}
+
+	transportA, ok := agentA.operationalTransport().(*http.Transport)
+	require.True(t, ok)
+	transportB, ok := agentB.operationalTransport().(*http.Transport)
+	require.True(t, ok)
+	assert.True(t, transportA != transportB)
+	assert.True(t, transportA != defaultHTTPTransport)
+	assert.Same(t, transportA, agentA.operationalTransport())
+
+	assert.Equal(t, 2, transportA.MaxIdleConns)
+	assert.Equal(t, 30*time.Second, transportA.IdleConnTimeout)
+	assert.Equal(t, 5, transportB.MaxIdleConns)
+	assert.Equal(t, time.Minute, transportB.IdleConnTimeout)
+
+	// the application's requests still use the shared transport
+	assert.Same(t, defaultHTTPTransport, agentA.transport())
+
+	// a custom Transport is only used for the application's requests
+	custom := roundTripperFunc(func(req *http.Request) (*http.Response, error) { return nil, nil })
+	agentC := &Agent{Transport: custom, OperationalMaxIdleConns: 5}
+	transportC, ok := agentC.operationalTransport().(*http.Transport)
+	require.True(t, ok)
+	assert.Equal(t, 5, transportC.MaxIdleConns)
+
+	agentC.OperationalTransport = custom
+	assert.NotNil(t, agentC.operationalTransport())
+	_, ok = agentC.operationalTransport().(*http.Transport)
+	assert.False(t, ok)
+}
+
+func TestAgent_OperationalProxy(t *testing.T) {
+	var (
+		mutex sync.Mutex
+		hosts []string
+	)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mutex.Lock()
+		hosts = append(hosts, req.Method+" "+req.Host)
+		mutex.Unlock()
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer proxy.Close()
+	proxyURL, err := url.Parse(proxy.URL)
+	require.NoError(t, err)
+
+	agent := &Agent{SecretKey: "sk", OperationalProxy: http.ProxyURL(proxyURL)}
+	_, err = agent.Config()
+	require.Error(t, err)
+
+	// the proxy is used along with a custom Transport, i.e., with Wrap
+	var wrapped int
+	agent = Init("sk").Wrap(roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		wrapped++
+		return nil, errors.New("unexpected")
+	}))
+	agent.OperationalProxy = http.ProxyURL(proxyURL)
+	_, err = agent.Config()
+	require.Error(t, err)
+	assert.Zero(t, wrapped)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	assert.Equal(t, []string{"CONNECT config.bearer.sh:443", "CONNECT config.bearer.sh:443"}, hosts)
+}
+
+func TestAgent_newRecord_CompactJSONBodies(t *testing.T) {
+	pretty := "{\n  \"name\": \"hello world\",\n  \"password\": \"secret\"\n}\n"
+	req, err := http.NewRequest("POST", "http://api.example.com/sample", nil)
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "text/plain")
+	resp := &http.Response{
+		StatusCode: 200,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       ioutil.NopCloser(strings.NewReader(pretty)),
+	}
+
+	agent := &Agent{CompactJSONBodies: true}
+	record := agent.newRecord(req, resp, time.Now(), time.Now(), []byte(pretty), nil)
+	assert.Equal(t, `{"name":"hello world","password":"[FILTERED]"}`, record.ResponseBody)
+	assert.True(t, json.Valid([]byte(record.ResponseBody)))
+	// non-JSON bodies are kept as-is
+	assert.Equal(t, pretty, record.RequestBody)
+
+	// JSON bodies which are not objects are not re-encoded by the sanitizer
+	req.Header.Set("Content-Type", "application/json")
+	record = agent.newRecord(req, resp, time.Now(), time.Now(), []byte("[\n  1,\n  2\n]"), nil)
+	assert.Equal(t, `[1,2]`, record.RequestBody)
+}
+
+func TestAgent_CaptureCallSite(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer ts.Close()
+
+	var records []ReportLog
+	agent := &Agent{
+		SecretKey:       "sk",
+		DryRun:          true,
+		DisableBlocking: true,
+		CaptureCallSite: true,
+		Transport:       http.DefaultTransport,
+		ProcessRecord: func(record *ReportLog) bool {
+			records = append(records, *record)
+			return false
+		},
+	}
+	client := &http.Client{Transport: agent}
+	_, _, line, _ := runtime.Caller(0)
+	resp, err := client.Get(ts.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	require.Len(t, records, 1)
+	assert.True(t, strings.HasSuffix(records[0].CallSite, fmt.Sprintf("agent_test.go:%d", line+1)), records[0].CallSite)
+
+	// disabled by default
+	agent.CaptureCallSite = false
+	resp, err = client.Get(ts.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Len(t, records, 2)
+	assert.Empty(t, records[1].CallSite)
+}
+
+func TestAgent_Flush(t *testing.T) {
+	release := make(chan struct{})
+	transport := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		<-release
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+	})
+	agent := &Agent{SecretKey: "sk", Transport: transport, OperationalTransport: transport, FlushTimeout: 50 * time.Millisecond}
+	agent.sendRecord(ReportLog{Type: RequestEnd})
+	agent.sendRecord(ReportLog{Type: RequestEnd})
+
+	start := time.Now()
+	err := agent.Flush()
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.Contains(t, err.Error(), "2 undelivered records")
+	assert.True(t, time.Since(start) < time.Second)
+
+	close(release)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, agent.FlushContext(ctx))
+	assert.Equal(t, 2, agent.Stats().RecordsSent)
+}
+
+func TestAgent_CaptureRedirects(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/old", func(w http.ResponseWriter, req *http.Request) {
+		http.Redirect(w, req, "/new", http.StatusFound)
+	})
+	mux.HandleFunc("/new", func(w http.ResponseWriter, req *http.Request) {})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	var records []ReportLog
+	agent := &Agent{
+		SecretKey:        "sk",
+		DisableBlocking:  true,
+		CaptureRedirects: true,
+		Transport:        http.DefaultTransport,
+		ProcessRecord: func(record *ReportLog) bool {
+			records = append(records, *record)
+			return false
+		},
+	}
+	client := &http.Client{Transport: agent}
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(ts.URL + "/old")
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, 200, resp.StatusCode)
+	}
+
+	require.Len(t, records, 4)
+	assert.Equal(t, "/old", records[0].Path)
+	assert.Equal(t, 302, records[0].StatusCode)
+	assert.Equal(t, 1, records[0].RedirectHop)
+	assert.NotEmpty(t, records[0].RedirectID)
+	assert.Equal(t, "/new", records[1].Path)
+	assert.Equal(t, 200, records[1].StatusCode)
+	assert.Equal(t, 2, records[1].RedirectHop)
+	assert.Equal(t, records[0].RedirectID, records[1].RedirectID)
+	// each chain has its own id
+	assert.NotEqual(t, records[0].RedirectID, records[2].RedirectID)
+	assert.Equal(t, records[2].RedirectID, records[3].RedirectID)
+
+	// requests which are not redirected are not linked
+	resp, err := client.Get(ts.URL + "/new")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Len(t, records, 5)
+	assert.Empty(t, records[4].RedirectID)
+	assert.Zero(t, records[4].RedirectHop)
+}
+
+func TestAgent_CaptureRedirects_DefaultRequestTimeout(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/old", func(w http.ResponseWriter, req *http.Request) {
+		http.Redirect(w, req, "/new", http.StatusFound)
+	})
+	mux.HandleFunc("/new", func(w http.ResponseWriter, req *http.Request) {})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	var records []ReportLog
+	agent := &Agent{
+		SecretKey:             "sk",
+		DisableBlocking:       true,
+		CaptureRedirects:      true,
+		DefaultRequestTimeout: time.Second,
+		Transport:             http.DefaultTransport,
+		ProcessRecord: func(record *ReportLog) bool {
+			records = append(records, *record)
+			return false
+		},
+	}
+	resp, err := (&http.Client{Transport: agent}).Get(ts.URL + "/old")
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	require.Len(t, records, 2)
+	assert.Equal(t, 1, records[0].RedirectHop)
+	assert.NotEmpty(t, records[0].RedirectID)
+	assert.Equal(t, "/new", records[1].Path)
+	assert.Equal(t, 2, records[1].RedirectHop)
+	assert.Equal(t, records[0].RedirectID, records[1].RedirectID)
+}
+
+func TestAgent_CaptureRedirects_FinalBody(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/moved", func(w http.ResponseWriter, req *http.Request) {
+		http.Redirect(w, req, "/temporary", http.StatusMovedPermanently)
+	})
+	mux.HandleFunc("/temporary", func(w http.ResponseWriter, req *http.Request) {
+		http.Redirect(w, req, "/user", http.StatusTemporaryRedirect)
+	})
+	mux.HandleFunc("/user", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"password":"hunter2","user":"bob"}`))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	var records []ReportLog
+	agent := &Agent{
+		SecretKey:        "sk",
+		DisableBlocking:  true,
+		CaptureRedirects: true,
+		Transport:        http.DefaultTransport,
+		ProcessRecord: func(record *ReportLog) bool {
+			records = append(records, *record)
+			return false
+		},
+	}
+	resp, err := (&http.Client{Transport: agent}).Get(ts.URL + "/moved")
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, `{"password":"hunter2","user":"bob"}`, string(body))
+
+	require.Len(t, records, 3)
+	for i, status := range []int{301, 307} {
+		assert.Equal(t, status, records[i].StatusCode)
+		assert.Equal(t, i+1, records[i].RedirectHop)
+		assert.Empty(t, records[i].ResponseBody)
+	}
+	assert.Equal(t, "/user", records[2].Path)
+	assert.Equal(t, 3, records[2].RedirectHop)
+	assert.Equal(t, `{"password":"[FILTERED]","user":"bob"}`, records[2].ResponseBody)
+}
+
+func TestAgent_newRecord_StaticTags(t *testing.T) {
+	req, err := http.NewRequest("GET", "http://api.example.com/sample", nil)
+	require.NoError(t, err)
+	resp := &http.Response{StatusCode: 200, Header: http.Header{}}
+
+	tags := map[string]string{"service": "billing", "env": "prod", "owner": "team@example.com", "api_key": "secret"}
+	agent := &Agent{StaticTags: tags}
+	record := agent.newRecord(req, resp, time.Now(), time.Now(), nil, nil)
+	assert.Equal(t, map[string]string{"service": "billing", "env": "prod", "owner": "team@example.com", "api_key": "[FILTERED]"}, record.Tags)
+
+	// records do not share the agent's map
+	record.Tags["region"] = "eu-west-1"
+	assert.NotContains(t, tags, "region")
+	assert.Equal(t, "secret", tags["api_key"])
+
+	record = (&Agent{}).newRecord(req, resp, time.Now(), time.Now(), nil, nil)
+	assert.Nil(t, record.Tags)
+}
+
+func TestAgent_newRecord_EncodeBinaryBodies(t *testing.T) {
+	binary := "hello \xff\xfe\x00 world"
+	req, err := http.NewRequest("POST", "http://api.example.com/sample", nil)
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "text/plain")
+	resp := &http.Response{
+		StatusCode: 200,
+		Header:     http.Header{"Content-Type": {"text/plain"}},
+		Body:       ioutil.NopCloser(strings.NewReader(binary)),
+	}
+
+	agent := &Agent{EncodeBinaryBodies: true}
+	record := agent.newRecord(req, resp, time.Now(), time.Now(), []byte("hello world"), nil)
+	assert.Equal(t, "hello world", record.RequestBody)
+	assert.Empty(t, record.RequestBodyEncoding)
+	assert.Equal(t, "base64", record.ResponseBodyEncoding)
+
+	// the body survives JSON marshaling
+	out, err := json.Marshal(record)
+	require.NoError(t, err)
+	var decoded ReportLog
+	require.NoError(t, json.Unmarshal(out, &decoded))
+	body, err := base64.StdEncoding.DecodeString(decoded.ResponseBody)
+	require.NoError(t, err)
+	assert.Equal(t, binary, string(body))
+}
+
+func TestAgent_newRecord_MaxBodySize(t *testing.T) {
+	large := strings.Repeat("a", 90) + "ééééé"
+	req, err := http.NewRequest("POST", "http://api.example.com/sample", nil)
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "text/plain")
+	resp := &http.Response{
+		StatusCode: 200,
+		Header:     http.Header{"Content-Type": {"text/plain"}},
+		Body:       ioutil.NopCloser(strings.NewReader(large)),
+	}
+
+	core, observed := observer.New(zap.WarnLevel)
+	agent := &Agent{MaxBodySize: 91, WarnOnTruncatedBodies: true, Logger: zap.New(core)}
+	record := agent.newRecord(req, resp, time.Now(), time.Now(), []byte("small"), nil)
+	// UTF-8 characters are not split
+	assert.Equal(t, strings.Repeat("a", 90), record.ResponseBody)
+	assert.Equal(t, 100, record.OriginalResponseBodySize)
+	assert.Equal(t, "small", record.RequestBody)
+	assert.Zero(t, record.OriginalRequestBodySize)
+	assert.Equal(t, 1, agent.Stats().TruncatedBodies)
+	entries := observed.FilterMessage("body truncated").All()
+	require.Len(t, entries, 1)
+	assert.Equal(t, int64(100), entries[0].ContextMap()["responseBodySize"])
+
+	// the application still reads the whole body
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, large, string(body))
+}
+
+func TestContextWithMaxBodySize(t *testing.T) {
+	large := strings.Repeat("a", 100)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(large))
+	}))
+	defer ts.Close()
+
+	fb := &fakeBearer{}
+	agent := &Agent{SecretKey: "sk", Transport: fb, OperationalTransport: fb, SynchronousDelivery: true, MaxBodySize: 10}
+	client := &http.Client{Transport: agent}
+	for _, ctx := range []context.Context{
+		context.Background(),
+		ContextWithMaxBodySize(context.Background(), 50),
+		ContextWithMaxBodySize(context.Background(), UnlimitedBodySize),
+	} {
+		req, err := http.NewRequestWithContext(ctx, "GET", ts.URL, nil)
+		require.NoError(t, err)
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+
+	logs := fb.waitLogs(t, 3)
+	assert.Equal(t, large[:10], logs[0].ResponseBody)
+	assert.Equal(t, large[:50], logs[1].ResponseBody)
+	assert.Equal(t, 100, logs[1].OriginalResponseBodySize)
+	assert.Equal(t, large, logs[2].ResponseBody)
+	assert.Zero(t, logs[2].OriginalResponseBodySize)
+	assert.Equal(t, 2, agent.Stats().TruncatedBodies)
+}
+
+func TestAgent_newRecord_MaxCapturedResponseSize(t *testing.T) {
+	req, err := http.NewRequest("GET", "http://api.example.com/export", nil)
+	require.NoError(t, err)
+	agent := &Agent{MaxCapturedResponseSize: 10}
+
+	t.Run("large Content-Length", func(t *testing.T) {
+		body := &countingBody{Reader: strings.NewReader("huge")}
+		resp := &http.Response{
+			StatusCode:    200,
+			Header:        http.Header{"Content-Type": {"text/plain"}},
+			ContentLength: 10 << 20,
+			Body:          body,
+		}
+		record := agent.newRecord(req, resp, time.Now(), time.Now(), nil, nil)
+		assert.True(t, record.ResponseBodySkipped)
+		assert.Empty(t, record.ResponseBody)
+		assert.Equal(t, 10<<20, record.BytesReceived)
+		assert.Zero(t, body.reads)
+		assert.Equal(t, body, resp.Body)
+	})
+
+	t.Run("unknown Content-Length", func(t *testing.T) {
+		large := strings.Repeat("a", 100)
+		body := &countingBody{Reader: strings.NewReader(large)}
+		resp := &http.Response{
+			StatusCode:    200,
+			Header:        http.Header{"Content-Type": {"text/plain"}},
+			ContentLength: -1,
+			Body:          body,
+		}
+		record := agent.newRecord(req, resp, time.Now(), time.Now(), nil, nil)
+		assert.True(t, record.ResponseBodySkipped)
+		assert.Empty(t, record.ResponseBody)
+
+		// the application still reads the whole body, and closes the original one
+		got, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, large, string(got))
+		require.NoError(t, resp.Body.Close())
+		assert.True(t, body.closed)
+	})
+
+	t.Run("small", func(t *testing.T) {
+		resp := &http.Response{
+			StatusCode:    200,
+			Header:        http.Header{"Content-Type": {"text/plain"}},
+			ContentLength: -1,
+			Body:          ioutil.NopCloser(strings.NewReader("small")),
+		}
+		record := agent.newRecord(req, resp, time.Now(), time.Now(), nil, nil)
+		assert.False(t, record.ResponseBodySkipped)
+		assert.Equal(t, "small", record.ResponseBody)
+	})
+}
+
+// countingBody is a body counting its reads.
+type countingBody struct {
+	io.Reader
+	reads  int
+	closed bool
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	b.reads++
+	return b.Reader.Read(p)
+}
+
+func (b *countingBody) Close() error {
+	b.closed = true
+	return nil
+}
+
+func TestAgent_DefaultRequestTimeout(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/hang" {
+			select {
+			case <-req.Context().Done():
+			case <-release:
+			}
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	agent := &Agent{
+		SecretKey:             "sk",
+		DisableBlocking:       true,
+		DefaultRequestTimeout: 100 * time.Millisecond,
+		Transport:             http.DefaultTransport,
+		ProcessRecord:         func(*ReportLog) bool { return false },
+	}
+	client := &http.Client{Transport: agent}
+
+	t.Run("no deadline", func(t *testing.T) {
+		start := time.Now()
+		_, err := client.Get(ts.URL + "/hang")
+		elapsed := time.Since(start)
+		assert.True(t, errors.Is(err, context.DeadlineExceeded), "%v", err)
+		assert.True(t, elapsed >= 100*time.Millisecond && elapsed < time.Second, "timed out after %s", elapsed)
+	})
+
+	t.Run("existing deadline", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, "GET", ts.URL+"/hang", nil)
+		require.NoError(t, err)
+		start := time.Now()
+		_, err = client.Do(req)
+		elapsed := time.Since(start)
+		assert.True(t, errors.Is(err, context.DeadlineExceeded), "%v", err)
+		assert.True(t, elapsed >= 300*time.Millisecond, "timed out after %s", elapsed)
+	})
+
+	t.Run("body read after the round trip", func(t *testing.T) {
+		resp, err := client.Get(ts.URL + "/fast")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "ok", string(body))
+	})
+}
+
+func TestContextWithAttempt(t *testing.T) {
+	attempts := 0
+	fb := &fakeBearer{next: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		attempts++
+		if attempts == 1 {
+			return fakeResponse(req, 503, "{}"), nil
+		}
+		return fakeResponse(req, 200, "{}"), nil
+	})}
+	agent := &Agent{SecretKey: "sk", Transport: fb, OperationalTransport: fb, CorrelationIDHeader: "X-Correlation-Id"}
+
+	for attempt := 1; attempt <= 2; attempt++ {
+		req, err := http.NewRequestWithContext(ContextWithAttempt(context.Background(), attempt), "GET", "http://api.example.com/flaky", nil)
+		require.NoError(t, err)
+		req.Header.Set("X-Correlation-Id", "retried")
+		resp, err := agent.RoundTrip(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+
+	logs := fb.waitLogs(t, 2)
+	byAttempt := map[int]ReportLog{}
+	for _, log := range logs {
+		byAttempt[log.Attempt] = log
+	}
+	require.Len(t, byAttempt, 2)
+	assert.Equal(t, 503, byAttempt[1].StatusCode)
+	assert.Equal(t, 200, byAttempt[2].StatusCode)
+	assert.Equal(t, "retried", byAttempt[1].CorrelationID)
+	assert.Equal(t, "retried", byAttempt[2].CorrelationID)
+}
+
+func TestAgent_newRecord_CaptureGraphQLOperation(t *testing.T) {
+	agent := &Agent{CaptureGraphQLOperation: true}
+	for body, expected := range map[string]string{
+		`{"query":"query GetUser($id: ID!) { user(id: $id) { name } }","variables":{"id":"1"}}`: "GetUser",
+		`{"query":"query A { a } query B { b }","operationName":"B"}`:                           "B",
+		`{"query":"{ user { name } }","variables":{}}`:                                          "",
+		`{"name":"not graphql"}`: "",
+	} {
+		req, err := http.NewRequest("POST", "http://api.example.com/graphql", nil)
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		resp := &http.Response{StatusCode: 200, Header: http.Header{}, Body: ioutil.NopCloser(strings.NewReader(""))}
+		record := agent.newRecord(req, resp, time.Now(), time.Now(), []byte(body), nil)
+		assert.Equal(t, expected, record.GraphQLOperation, body)
+	}
+}
+
+func TestAgent_newRecord_HashBodies(t *testing.T) {
+	req, err := http.NewRequest("POST", "http://api.example.com/sample", nil)
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp := &http.Response{
+		StatusCode: 200,
+		Header:     http.Header{"Content-Type": {"text/plain"}},
+		Body:       ioutil.NopCloser(strings.NewReader("hello world")),
+	}
+
+	agent := &Agent{HashBodies: true}
+	record := agent.newRecord(req, resp, time.Now(), time.Now(), []byte("password=secret"), nil)
+	assert.Equal(t, "sha256:b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9", record.ResponseBody)
+	// the digest is of the body as sent, not of the sanitized body
+	assert.Equal(t, "sha256:ef9f9093ba992665339b33c899e3770b1e34891e4ca62c34d234bef901c0e329", record.RequestBody)
+	assert.Nil(t, record.RequestForm)
+	assert.True(t, record.BodiesHashed)
+	// the application still reads the original body
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(body))
+
+	// nothing is hashed when bodies are not captured
+	agent = &Agent{HashBodies: true, MetadataOnly: true}
+	resp.Body = ioutil.NopCloser(strings.NewReader("hello world"))
+	record = agent.newRecord(req, resp, time.Now(), time.Now(), []byte("password=secret"), nil)
+	assert.Empty(t, record.RequestBody)
+	assert.Empty(t, record.ResponseBody)
+	assert.False(t, record.BodiesHashed)
+}
+
+type upgradedConn struct {
+	read bool
+}
+
+func (c *upgradedConn) Read(p []byte) (int, error)  { c.read = true; return 0, io.EOF }
+func (c *upgradedConn) Write(p []byte) (int, error) { return len(p), nil }
+func (c *upgradedConn) Close() error                { return nil }
+
+func TestAgent_WebSocketUpgrade(t *testing.T) {
+	conn := &upgradedConn{}
+	transport := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusSwitchingProtocols,
+			Header: http.Header{
+				"Upgrade":      {"websocket"},
+				"Connection":   {"Upgrade"},
+				"Content-Type": {"text/plain"},
+			},
+			Body: conn,
+		}, nil
+	})
+	var records []ReportLog
+	agent := &Agent{
+		SecretKey:            "sk",
+		DisableBlocking:      true,
+		Transport:            transport,
+		OperationalTransport: transport,
+		ProcessRecord: func(record *ReportLog) bool {
+			records = append(records, *record)
+			return false
+		},
+	}
+
+	req, err := http.NewRequest("GET", "http://api.example.com/ws", nil)
+	require.NoError(t, err)
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	resp, err := agent.RoundTrip(req)
+	require.NoError(t, err)
+
+	assert.False(t, conn.read)
+	assert.Same(t, conn, resp.Body)
+	require.Len(t, records, 1)
+	assert.Equal(t, 101, records[0].StatusCode)
+	assert.Equal(t, "websocket", records[0].RequestHeaders["Upgrade"])
+	assert.Equal(t, "websocket", records[0].ResponseHeaders["Upgrade"])
+	assert.Empty(t, records[0].ResponseBody)
+}
+
+func TestAgent_WebSocketUpgrade_CaptureTimings(t *testing.T) {
+	conn := &upgradedConn{}
+	transport := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusSwitchingProtocols,
+			Header:     http.Header{"Upgrade": {"websocket"}, "Connection": {"Upgrade"}},
+			Trailer:    http.Header{"Grpc-Status": nil},
+			Body:       conn,
+		}, nil
+	})
+	var records []ReportLog
+	agent := &Agent{
+		SecretKey:            "sk",
+		DisableBlocking:      true,
+		CaptureTimings:       true,
+		CaptureTrailers:      true,
+		Transport:            transport,
+		OperationalTransport: transport,
+		ProcessRecord: func(record *ReportLog) bool {
+			records = append(records, *record)
+			return false
+		},
+	}
+
+	req, err := http.NewRequest("GET", "http://api.example.com/ws", nil)
+	require.NoError(t, err)
+	req.Header.Set("Upgrade", "websocket")
+	resp, err := agent.RoundTrip(req)
+	require.NoError(t, err)
+
+	assert.Same(t, conn, resp.Body)
+	// the record is not waiting for the body of the connection
+	require.Len(t, records, 1)
+	assert.Equal(t, 101, records[0].StatusCode)
+}
+
+func TestAgent_WebSocketUpgrade_DefaultRequestTimeout(t *testing.T) {
+	conn := &upgradedConn{}
+	var ctx context.Context
+	transport := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		ctx = req.Context()
+		return &http.Response{
+			StatusCode: http.StatusSwitchingProtocols,
+			Header:     http.Header{"Upgrade": {"websocket"}, "Connection": {"Upgrade"}},
+			Body:       conn,
+		}, nil
+	})
+	agent := &Agent{
+		SecretKey:             "sk",
+		DisableBlocking:       true,
+		DefaultRequestTimeout: time.Minute,
+		Transport:             transport,
+		OperationalTransport:  transport,
+		ProcessRecord:         func(*ReportLog) bool { return false },
+	}
+
+	req, err := http.NewRequest("GET", "http://api.example.com/ws", nil)
+	require.NoError(t, err)
+	req.Header.Set("Upgrade", "websocket")
+	resp, err := agent.RoundTrip(req)
+	require.NoError(t, err)
+
+	assert.Same(t, conn, resp.Body)
+	// the timeout is released, so it does not close the upgraded connection later
+	_, hasDeadline := ctx.Deadline()
+	assert.True(t, hasDeadline)
+	assert.Equal(t, context.Canceled, ctx.Err())
+}
+
+func TestAgent_sendRecord_ContextCancelled(t *testing.T) {
+	started := make(chan struct{})
+	var delivered int32
+	transport := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		close(started)
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(5 * time.Second):
+			atomic.AddInt32(&delivered, 1)
+			return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+		}
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	agent := &Agent{SecretKey: "sk", Transport: transport, OperationalTransport: transport, Context: ctx}
+
+	agent.sendRecord(ReportLog{Type: RequestEnd})
+	<-started
+	cancel()
+	for agent.Stats().PendingRecords > 0 {
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert.Equal(t, int32(0), atomic.LoadInt32(&delivered))
+	assert.Equal(t, 0, agent.Stats().RecordsSent)
+	assert.Equal(t, 1, agent.Stats().RecordsDropped)
+
+	// once the context is done, new records are not delivered at all
+	agent.sendRecord(ReportLog{Type: RequestEnd})
+	assert.Equal(t, 2, agent.Stats().RecordsDropped)
+	assert.Equal(t, 0, agent.Stats().PendingRecords)
+
+	// the delivery worker has exited
+	waitBackground(t, agent)
+}
+
+func TestAgent_refreshConfig_ContextCancelled(t *testing.T) {
+	fb := &fakeBearer{}
+	ctx, cancel := context.WithCancel(context.Background())
+	agent := &Agent{SecretKey: "sk", OperationalTransport: fb, Context: ctx, RefreshConfigEvery: 10 * time.Millisecond}
+	agent.config()
+	for agent.Stats().ConfigUpdates < 2 {
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+	waitBackground(t, agent)
+
+	fb.mutex.Lock()
+	fetches := fb.configFetches
+	fb.mutex.Unlock()
+	time.Sleep(50 * time.Millisecond)
+	fb.mutex.Lock()
+	defer fb.mutex.Unlock()
+	assert.Equal(t, fetches, fb.configFetches)
+}
+
+// waitBackground waits for the background goroutines of agent to exit.
+func waitBackground(t *testing.T, agent *Agent) {
+	t.Helper()
+	exited := make(chan struct{})
+	go func() {
+		agent.background.Wait()
+		close(exited)
+	}()
+	select {
+	case <-exited:
+	case <-time.After(2 * time.Second):
+		t.Fatal("background goroutines still running")
+	}
+}
+
+func TestAgent_RoundTrip_GetBody(t *testing.T) {
+	var received []string
+	transport := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		body, err := ioutil.ReadAll(req.Body)
+		require.NoError(t, err)
+		received = append(received, string(body))
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+	})
+	agent := &Agent{SecretKey: "sk", DisableBlocking: true, DryRun: true, Logger: zap.NewNop(), Transport: transport, OperationalTransport: transport}
+
+	// a reader which cannot be replayed, so http.NewRequest does not set GetBody
+	req, err := http.NewRequest("PUT", "http://api.example.com/upload", ioutil.NopCloser(strings.NewReader("payload")))
+	require.NoError(t, err)
+	require.Nil(t, req.GetBody)
+	_, err = agent.RoundTrip(req)
+	require.NoError(t, err)
+
+	require.NotNil(t, req.GetBody)
+	for i := 0; i < 2; i++ {
+		body, err := req.GetBody()
+		require.NoError(t, err)
+		buf, err := ioutil.ReadAll(body)
+		require.NoError(t, err)
+		assert.Equal(t, "payload", string(buf))
+	}
+
+	// a retry sends the original body
+	req.Body, err = req.GetBody()
+	require.NoError(t, err)
+	_, err = agent.RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"payload", "payload"}, received)
+}
+
+type unreadableBody struct {
+	read bool
+}
+
+func (b *unreadableBody) Read(p []byte) (int, error) { b.read = true; return 0, io.EOF }
+func (b *unreadableBody) Close() error               { return nil }
+
+func TestAgent_newRecord_NoBody(t *testing.T) {
+	for _, test := range []struct {
+		method     string
+		statusCode int
+	}{
+		{"HEAD", 200},
+		{"GET", 204},
+		{"GET", 304},
+	} {
+		t.Run(fmt.Sprintf("%s/%d", test.method, test.statusCode), func(t *testing.T) {
+			req, err := http.NewRequest(test.method, "http://api.example.com/sample", nil)
+			require.NoError(t, err)
+			body := &unreadableBody{}
+			resp := &http.Response{
+				StatusCode:    test.statusCode,
+				Header:        http.Header{"Content-Type": {"application/json"}, "Etag": {`"abc"`}},
+				ContentLength: 42,
+				Body:          body,
+			}
+			record := (&Agent{}).newRecord(req, resp, time.Now(), time.Now(), nil, nil)
+			assert.False(t, body.read)
+			assert.Same(t, body, resp.Body)
+			assert.Equal(t, test.statusCode, record.StatusCode)
+			assert.Equal(t, `"abc"`, record.ResponseHeaders["Etag"])
+			assert.Empty(t, record.ResponseBody)
+		})
+	}
+}
+
+func TestAgent_RecordCancellations(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-req.Context().Done()
+	}))
+	defer ts.Close()
+
+	for _, recordCancellations := range []bool{false, true} {
+		t.Run(fmt.Sprintf("%t", recordCancellations), func(t *testing.T) {
+			var records []ReportLog
+			agent := &Agent{
+				SecretKey:           "sk",
+				DisableBlocking:     true,
+				RecordCancellations: recordCancellations,
+				Transport:           http.DefaultTransport,
+				ProcessRecord: func(record *ReportLog) bool {
+					records = append(records, *record)
+					return false
+				},
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			req, err := http.NewRequestWithContext(ctx, "GET", ts.URL, nil)
+			require.NoError(t, err)
+			_, err = (&http.Client{Transport: agent}).Do(req)
+			require.Error(t, err)
+			assert.True(t, errors.Is(err, context.DeadlineExceeded))
+
+			if !recordCancellations {
+				assert.Empty(t, records)
+				return
+			}
+			require.Len(t, records, 1)
+			assert.Equal(t, RequestCancelled, records[0].Type)
+			assert.Zero(t, records[0].StatusCode)
+		})
+	}
+}
+
+func TestAgent_RequestError(t *testing.T) {
+	for _, safeMode := range []bool{false, true} {
+		t.Run(fmt.Sprintf("SafeMode=%t", safeMode), func(t *testing.T) {
+			records := make(chan ReportLog, 1)
+			agent := &Agent{
+				SecretKey:       "sk",
+				DisableBlocking: true,
+				SafeMode:        safeMode,
+				Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+					return nil, errors.New("connection refused")
+				}),
+				ProcessRecord: func(record *ReportLog) bool {
+					records <- *record
+					return false
+				},
+			}
+			req, err := http.NewRequest("GET", "http://api.example.com/sample", nil)
+			require.NoError(t, err)
+			_, err = agent.RoundTrip(req)
+			require.Error(t, err)
+
+			// in SafeMode, the request is recorded in the background
+			var record ReportLog
+			select {
+			case record = <-records:
+			case <-time.After(2 * time.Second):
+				t.Fatal("request not recorded")
+			}
+			assert.Equal(t, RequestError, record.Type)
+			assert.Zero(t, record.StatusCode)
+			assert.Equal(t, "/sample", record.Path)
+		})
+	}
+}
+
+func TestAgent_newRecord_RequestForm(t *testing.T) {
+	req, err := http.NewRequest("POST", "http://api.example.com/login", nil)
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp := &http.Response{StatusCode: 200, Header: http.Header{}}
+
+	body := "name=john&password=secret&email=john%40example.com&tag=a&tag=b"
+	record := (&Agent{}).newRecord(req, resp, time.Now(), time.Now(), []byte(body), nil)
+	assert.Equal(t, map[string]string{
+		"name":     "john",
+		"password": "[FILTERED]",
+		"email":    "[FILTERED]",
+		"tag":      "a",
+	}, record.RequestForm)
+	assert.Equal(t, "email=%5BFILTERED%5D&name=john&password=%5BFILTERED%5D&tag=a&tag=b", record.RequestBody)
+
+	req.Header.Set("Content-Type", "application/json")
+	record = (&Agent{}).newRecord(req, resp, time.Now(), time.Now(), []byte(`{"name":"john"}`), nil)
+	assert.Nil(t, record.RequestForm)
+}
+
+func TestAgent_newRecord_StripQueryParams(t *testing.T) {
+	req, err := http.NewRequest("GET", "https://api.example.com/sample?token=secret&page=2", nil)
+	require.NoError(t, err)
+	resp := &http.Response{StatusCode: 200, Header: http.Header{}}
+
+	record := (&Agent{StripQueryParams: true}).newRecord(req, resp, time.Now(), time.Now(), nil, nil)
+	assert.Equal(t, "https://api.example.com/sample", record.URL)
+	u, err := url.Parse(record.URL)
+	require.NoError(t, err)
+	assert.Empty(t, u.RawQuery)
+	assert.Nil(t, record.QueryParams)
+	assert.Equal(t, "/sample", record.Path)
+	assert.Equal(t, "api.example.com", record.Hostname)
+}
+
+func TestAgent_BufferLen(t *testing.T) {
+	fb := &fakeBearer{}
+	agent := &Agent{SecretKey: "sk", Transport: fb, OperationalTransport: fb, maxBuffered: 10, flushPeriod: time.Hour}
+	assert.Equal(t, 0, agent.BufferLen())
+	assert.Equal(t, 10, agent.BufferCapacity())
+
+	for i := 0; i < 3; i++ {
+		agent.sendRecord(ReportLog{Type: RequestEnd})
+	}
+	assert.Equal(t, 3, agent.BufferLen())
+
+	require.NoError(t, agent.Flush())
+	fb.waitLogs(t, 3)
+	assert.Equal(t, 0, agent.BufferLen())
+
+	assert.Equal(t, 1000, (&Agent{}).BufferCapacity())
+}
+
+func TestAgent_CaptureTrailers(t *testing.T) {
+	for _, contentType := range []string{"text/plain", "application/octet-stream"} {
+		t.Run(contentType, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				w.Header().Set("Content-Type", contentType)
+				w.Header().Set("Trailer", "X-Checksum, Api-Key")
+				w.Write([]byte("hello world"))
+				w.Header().Set("X-Checksum", "abc123")
+				w.Header().Set("Api-Key", "secret")
+			}))
+			defer ts.Close()
+
+			var records []ReportLog
+			agent := &Agent{
+				SecretKey:       "sk",
+				DisableBlocking: true,
+				CaptureTrailers: true,
+				Transport:       http.DefaultTransport,
+				ProcessRecord: func(record *ReportLog) bool {
+					records = append(records, *record)
+					return false
+				},
+			}
+			resp, err := (&http.Client{Transport: agent}).Get(ts.URL)
+			require.NoError(t, err)
+			body, err := ioutil.ReadAll(resp.Body)
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, "hello world", string(body))
+			assert.Equal(t, "abc123", resp.Trailer.Get("X-Checksum"))
+
+			require.Len(t, records, 1)
+			assert.Equal(t, map[string]string{"X-Checksum": "abc123", "Api-Key": "[FILTERED]"}, records[0].ResponseTrailers)
+			assert.Equal(t, 11, records[0].BytesReceived)
+		})
+	}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+func TestAgent_SpoolDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bearer-spool")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// the first process can not deliver its records before dying
+	unavailable := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Hostname() == "agent.bearer.sh" {
+			return fakeResponse(req, 503, "{}"), nil
+		}
+		return (&fakeBearer{}).RoundTrip(req)
+	})
+	agent := &Agent{SecretKey: "sk", DisableBlocking: true, SpoolDir: dir, Transport: unavailable, OperationalTransport: unavailable}
+	agent.sendRecord(ReportLog{Type: RequestEnd, URL: "http://api.example.com/a"})
+	agent.sendRecord(ReportLog{Type: RequestEnd, URL: "http://api.example.com/b"})
+	require.NoError(t, agent.Flush())
+	assert.Equal(t, 2, agent.Stats().RecordsDropped)
+
+	// a partially written line is ignored
+	files, err := filepath.Glob(filepath.Join(dir, "*.jsonl"))
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	f, err := os.OpenFile(files[0], os.O_WRONLY|os.O_APPEND, 0600)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"id":3,"record":{"type":"REQ`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	// the next process delivers them
+	fb := &fakeBearer{}
+	agent = &Agent{SecretKey: "sk", DisableBlocking: true, SpoolDir: dir, Transport: fb, OperationalTransport: fb}
+	require.NoError(t, agent.Flush())
+	logs := fb.waitLogs(t, 2)
+	assert.ElementsMatch(t, []string{"http://api.example.com/a", "http://api.example.com/b"}, []string{logs[0].URL, logs[1].URL})
+
+	// and the delivered records are removed
+	agent.sendRecord(ReportLog{Type: RequestEnd, URL: "http://api.example.com/c"})
+	require.NoError(t, agent.Flush())
+	fb.waitLogs(t, 3)
+	files, err = filepath.Glob(filepath.Join(dir, "*.jsonl"))
+	require.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func TestAgent_SpoolDir_Compaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bearer-spool")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	fb := &fakeBearer{}
+	failed := false
+	transport := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Hostname() == "agent.bearer.sh" && !failed {
+			failed = true
+			return fakeResponse(req, 503, "{}"), nil
+		}
+		return fb.RoundTrip(req)
+	})
+	agent := &Agent{SecretKey: "sk", DisableBlocking: true, SpoolDir: dir, Transport: transport, OperationalTransport: transport, SynchronousDelivery: true}
+	agent.sendRecord(ReportLog{Type: RequestEnd, URL: "http://api.example.com/failed"})
+	for i := 0; i < 50; i++ {
+		agent.sendRecord(ReportLog{Type: RequestEnd, URL: "http://api.example.com/delivered", ResponseBody: strings.Repeat("a", 200)})
+	}
+	fb.waitLogs(t, 50)
+
+	// the delivered records do not accumulate behind the failed one
+	files, err := filepath.Glob(filepath.Join(dir, "*.jsonl"))
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	content, err := ioutil.ReadFile(files[0])
+	require.NoError(t, err)
+	assert.True(t, bytes.Count(content, []byte("\n")) < spoolCompactLines, "%d lines", bytes.Count(content, []byte("\n")))
+	records, err := readSpoolFile(files[0])
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, "http://api.example.com/failed", records[0].record.URL)
+}
+
+func TestAgent_MaxBatchBytes(t *testing.T) {
+	fb := &fakeBearer{}
+	var (
+		mutex sync.Mutex
+		sizes []int
+	)
+	agent := &Agent{
+		SecretKey:     "sk",
+		MaxBatchBytes: 4096,
+		flushPeriod:   time.Hour,
+		OperationalTransport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			if req.URL.Hostname() == "agent.bearer.sh" {
+				body, err := ioutil.ReadAll(req.Body)
+				require.NoError(t, err)
+				mutex.Lock()
+				sizes = append(sizes, len(body))
+				mutex.Unlock()
+				req.Body = ioutil.NopCloser(bytes.NewReader(body))
+			}
+			return fb.RoundTrip(req)
+		}),
+	}
+	// the batches are delivered as soon as they add up to MaxBatchBytes, without waiting for the flush interval
+	for i := 0; i < 20; i++ {
+		agent.sendRecord(ReportLog{
+			Type:         RequestEnd,
+			URL:          fmt.Sprintf("http://api.example.com/%d", i),
+			ResponseBody: strings.Repeat("a", 1000),
+		})
+	}
+	for agent.Stats().RecordsSent == 0 {
+		time.Sleep(5 * time.Millisecond)
+	}
+	require.NoError(t, agent.Flush())
+	logs := fb.waitLogs(t, 20)
+	for i, log := range logs {
+		// the order of the records is kept
+		assert.Equal(t, fmt.Sprintf("http://api.example.com/%d", i), log.URL)
+	}
+	mutex.Lock()
+	assert.True(t, len(sizes) > 1 && len(sizes) < 20, "%d batches", len(sizes))
+	for _, size := range sizes {
+		assert.True(t, size <= 4096, "batch of %d bytes", size)
+	}
+	sizes = nil
+	mutex.Unlock()
+
+	// a single large record is delivered anyway
+	agent.sendRecord(ReportLog{Type: RequestEnd, ResponseBody: strings.Repeat("a", 5000)})
+	require.NoError(t, agent.Flush())
+	fb.waitLogs(t, 21)
+	mutex.Lock()
+	defer mutex.Unlock()
+	assert.Len(t, sizes, 1)
+	assert.Equal(t, 21, agent.Stats().RecordsSent)
+}
+
+func TestAgent_OversizedRecords(t *testing.T) {
+	gigantic := ReportLog{
+		Type:         RequestEnd,
+		URL:          "http://api.example.com/large",
+		RequestBody:  strings.Repeat("r", 2000),
+		ResponseBody: strings.Repeat("\"", 1<<20),
+	}
+
+	t.Run("truncate", func(t *testing.T) {
+		fb := &fakeBearer{}
+		agent := &Agent{SecretKey: "sk", Transport: fb, OperationalTransport: fb, MaxBatchBytes: 4096}
+		require.NoError(t, agent.logRecords([]ReportLog{gigantic}))
+		logs := fb.waitLogs(t, 1)
+		assert.Equal(t, 1<<20, logs[0].OriginalResponseBodySize)
+		assert.True(t, len(logs[0].ResponseBody) < 4096)
+		out, _, err := JSONMarshaler(logs, agent.newLogsMetadata())
+		require.NoError(t, err)
+		assert.True(t, len(out) <= 4096, "%d bytes", len(out))
+		assert.Equal(t, 1, agent.Stats().OversizedRecords)
+	})
+
+	t.Run("drop", func(t *testing.T) {
+		fb := &fakeBearer{}
+		core, observed := observer.New(zap.WarnLevel)
+		agent := &Agent{SecretKey: "sk", Transport: fb, OperationalTransport: fb, MaxBatchBytes: 4096, DropOversizedRecords: true, Logger: zap.New(core)}
+		err := agent.logRecords([]ReportLog{gigantic})
+		var deliveryErr *DeliveryError
+		require.True(t, errors.As(err, &deliveryErr))
+		assert.Equal(t, http.StatusRequestEntityTooLarge, deliveryErr.StatusCode)
+		fb.waitLogs(t, 0)
+		assert.Len(t, observed.FilterMessageSnippet("dropped").All(), 1)
+		assert.Equal(t, 1, agent.Stats().OversizedRecords)
+	})
+}
+
+type panicSanitizer struct{}
+
+func (panicSanitizer) Sanitize(record *ReportLog) error { panic("sanitizer bug") }
+
+func TestAgent_SafeMode(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write(append([]byte("echo: "), body...))
+	}))
+	defer ts.Close()
+
+	t.Run("panic", func(t *testing.T) {
+		core, observed := observer.New(zap.ErrorLevel)
+		fb := &fakeBearer{}
+		agent := &Agent{SecretKey: "sk", Transport: fb, OperationalTransport: fb, SafeMode: true, Sanitizer: panicSanitizer{}, Logger: zap.New(core)}
+		resp, err := (&http.Client{Transport: agent}).Post(ts.URL, "text/plain", strings.NewReader("hello"))
+		require.NoError(t, err)
+		body, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, "echo: hello", string(body))
+
+		deadline := time.Now().Add(2 * time.Second)
+		for observed.FilterMessage("panic").Len() == 0 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert.Equal(t, 1, observed.FilterMessage("panic").Len())
+		fb.waitLogs(t, 0)
+	})
+
+	t.Run("record", func(t *testing.T) {
+		fb := &fakeBearer{}
+		agent := &Agent{SecretKey: "sk", Transport: fb, OperationalTransport: fb, SafeMode: true}
+		resp, err := (&http.Client{Transport: agent}).Post(ts.URL+"/safe", "text/plain", strings.NewReader("hello"))
+		require.NoError(t, err)
+		// nothing is recorded before the body is read
+		fb.waitLogs(t, 0)
+		body, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, "echo: hello", string(body))
+
+		logs := fb.waitLogs(t, 1)
+		assert.Equal(t, "/safe", logs[0].Path)
+		assert.Equal(t, "hello", logs[0].RequestBody)
+		assert.Equal(t, "echo: hello", logs[0].ResponseBody)
+	})
+
+	large := strings.Repeat("a", 100000)
+	tsLarge := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", req.URL.Query().Get("ct"))
+		w.Write([]byte(large))
+	}))
+	defer tsLarge.Close()
+	readLarge := func(t *testing.T, agent *Agent, contentType string) *http.Response {
+		resp, err := (&http.Client{Transport: agent}).Get(tsLarge.URL + "?ct=" + url.QueryEscape(contentType))
+		require.NoError(t, err)
+		body, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, large, string(body))
+		return resp
+	}
+
+	t.Run("MaxCapturedResponseSize", func(t *testing.T) {
+		fb := &fakeBearer{}
+		agent := &Agent{SecretKey: "sk", Transport: fb, OperationalTransport: fb, SafeMode: true, MaxCapturedResponseSize: 1000}
+		resp := readLarge(t, agent, "text/plain")
+		assert.Equal(t, 1001, resp.Body.(*captureBody).buf.Len())
+
+		logs := fb.waitLogs(t, 1)
+		assert.True(t, logs[0].ResponseBodySkipped)
+		assert.Empty(t, logs[0].ResponseBody)
+		assert.Equal(t, len(large), logs[0].BytesReceived)
+	})
+
+	t.Run("MaxBodySize", func(t *testing.T) {
+		fb := &fakeBearer{}
+		agent := &Agent{SecretKey: "sk", Transport: fb, OperationalTransport: fb, SafeMode: true, MaxBodySize: 10}
+		resp := readLarge(t, agent, "text/plain")
+		assert.Equal(t, 10+captureTruncationMargin, resp.Body.(*captureBody).buf.Len())
+
+		logs := fb.waitLogs(t, 1)
+		assert.Equal(t, large[:10], logs[0].ResponseBody)
+		assert.Equal(t, len(large), logs[0].OriginalResponseBodySize)
+		assert.Equal(t, len(large), logs[0].BytesReceived)
+	})
+
+	t.Run("binary", func(t *testing.T) {
+		fb := &fakeBearer{}
+		agent := &Agent{SecretKey: "sk", Transport: fb, OperationalTransport: fb, SafeMode: true}
+		resp := readLarge(t, agent, "application/octet-stream")
+		_, wrapped := resp.Body.(*captureBody)
+		assert.False(t, wrapped)
+
+		logs := fb.waitLogs(t, 1)
+		assert.Empty(t, logs[0].ResponseBody)
+	})
+
+	t.Run("upgrade", func(t *testing.T) {
+		conn := &upgradedConn{}
+		fb := &fakeBearer{next: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			return &http.Response{
+				StatusCode: http.StatusSwitchingProtocols,
+				Header:     http.Header{"Upgrade": {"websocket"}, "Connection": {"Upgrade"}, "Content-Type": {"text/plain"}},
+				Body:       conn,
+			}, nil
+		})}
+		agent := &Agent{SecretKey: "sk", Transport: fb, OperationalTransport: fb, SafeMode: true}
+		req, err := http.NewRequest("GET", "http://api.example.com/ws", nil)
+		require.NoError(t, err)
+		req.Header.Set("Upgrade", "websocket")
+		resp, err := agent.RoundTrip(req)
+		require.NoError(t, err)
+		assert.Same(t, conn, resp.Body)
+		_, ok := resp.Body.(io.ReadWriteCloser)
+		assert.True(t, ok)
+
+		logs := fb.waitLogs(t, 1)
+		assert.Equal(t, 101, logs[0].StatusCode)
+		assert.False(t, conn.read)
+	})
+}
+
+// fakeBearer is a RoundTripper emulating Bearer's config and logs endpoints,
+// other requests are forwarded to next (or to defaultHTTPTransport).
+type fakeBearer struct {
+	next       http.RoundTripper
+	config     Config
+	configHang chan struct{}
+
+	mutex         sync.Mutex
+	logs          []ReportLog
+	configFetches int
+}
+
+func (fb *fakeBearer) RoundTrip(req *http.Request) (*http.Response, error) {
+	switch req.URL.Hostname() {
+	case "config.bearer.sh":
+		if fb.configHang != nil {
+			<-fb.configHang
+		}
+		fb.mutex.Lock()
+		fb.configFetches++
+		body, _ := json.Marshal(fb.config)
+		fb.mutex.Unlock()
+		return fakeResponse(req, 200, string(body)), nil
+	case "agent.bearer.sh":
+		var input struct {
+			Logs []ReportLog `json:"logs"`
+		}
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(body, &input); err != nil {
+			return nil, err
+		}
+		fb.mutex.Lock()
+		fb.logs = append(fb.logs, input.Logs...)
+		fb.mutex.Unlock()
+		return fakeResponse(req, 200, "{}"), nil
+	}
+	if fb.next != nil {
+		return fb.next.RoundTrip(req)
+	}
+	return defaultHTTPTransport.RoundTrip(req)
+}
+
+// waitLogs waits until n logs were received, and checks that no more are coming.
+func (fb *fakeBearer) waitLogs(t *testing.T, n int) []ReportLog {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		fb.mutex.Lock()
+		count := len(fb.logs)
+		fb.mutex.Unlock()
+		if count >= n || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	fb.mutex.Lock()
+	defer fb.mutex.Unlock()
+	require.Len(t, fb.logs, n)
+	return append([]ReportLog{}, fb.logs...)
+}
+
+func fakeResponse(req *http.Request, statusCode int, body string) *http.Response {
+	return &http.Response{
+		StatusCode: statusCode,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       ioutil.NopCloser(strings.NewReader(body)),
+		Request:    req,
+	}
+}
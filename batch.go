@@ -0,0 +1,179 @@
+package bearer
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// queuedRecord is a record waiting in the buffer to be delivered, with its spool and ID in it (if any).
+type queuedRecord struct {
+	record  ReportLog
+	spool   *spool
+	spoolID uint64
+	// size is the estimated size of the encoding of the record, if MaxBatchBytes is set
+	size int
+}
+
+// recordBuffer holds the records waiting to be delivered by the agent's delivery worker.
+type recordBuffer struct {
+	once sync.Once
+	// added wakes up the worker once a record is buffered
+	added chan struct{}
+	// ready makes the worker deliver without waiting for the end of the flush interval
+	ready chan struct{}
+
+	mutex   sync.Mutex
+	records []queuedRecord
+	// size is the sum of the sizes of the buffered records
+	size int
+}
+
+// push buffers q, and returns false if the buffer already holds capacity records.
+// If there are batchSize records or more, or maxBytes bytes or more (if set), the worker is woken up to deliver them.
+func (b *recordBuffer) push(q queuedRecord, capacity, batchSize, maxBytes int) bool {
+	b.mutex.Lock()
+	if len(b.records) >= capacity {
+		b.mutex.Unlock()
+		return false
+	}
+	b.records = append(b.records, q)
+	b.size += q.size
+	n, size := len(b.records), b.size
+	b.mutex.Unlock()
+
+	if n == 1 {
+		notify(b.added)
+	}
+	if n >= batchSize || maxBytes > 0 && size >= maxBytes {
+		notify(b.ready)
+	}
+	return true
+}
+
+// take removes and returns at most n of the oldest buffered records, and, if maxBytes is set,
+// stops before their sizes add up to more than maxBytes. The oldest record is always returned.
+func (b *recordBuffer) take(n, maxBytes int) []queuedRecord {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if n > len(b.records) {
+		n = len(b.records)
+	}
+	size := 0
+	for i, q := range b.records[:n] {
+		if maxBytes > 0 && i > 0 && size+q.size > maxBytes {
+			n = i
+			break
+		}
+		size += q.size
+	}
+	batch := append([]queuedRecord{}, b.records[:n]...)
+	b.records = append(b.records[:0], b.records[n:]...)
+	b.size -= size
+	return batch
+}
+
+func (b *recordBuffer) len() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return len(b.records)
+}
+
+// notify signals ch without blocking, a signal already pending being enough.
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// buffer returns the buffer of the records to deliver, starting the delivery worker on the first call.
+func (a *Agent) buffer() *recordBuffer {
+	a.records.once.Do(func() {
+		a.records.added = make(chan struct{}, 1)
+		a.records.ready = make(chan struct{}, 1)
+		a.background.Add(1)
+		go a.deliveryWorker()
+	})
+	return &a.records
+}
+
+// deliveryWorker delivers the buffered records, in batches of at most 50 records and MaxBatchBytes bytes,
+// every 100ms, or as soon as a batch is full or a flush is requested.
+// Deliveries are performed one at a time, so that records accumulate in the buffer while Bearer is slow
+// or MaxDeliveriesPerSecond is reached, instead of triggering more requests.
+// Once the agent's context is done, the buffered records are dropped, and the worker exits.
+func (a *Agent) deliveryWorker() {
+	defer a.background.Done()
+	done := a.context().Done()
+	for {
+		if a.records.len() == 0 {
+			select {
+			case <-a.records.added:
+			case <-done:
+				return
+			}
+		}
+		timer := time.NewTimer(a.flushInterval())
+		select {
+		case <-timer.C:
+		case <-a.records.ready:
+			timer.Stop()
+		case <-done:
+			timer.Stop()
+			// delivering them fails right away, as for any record sent from now on
+			if batch := a.records.take(a.bufferSize(), 0); len(batch) > 0 {
+				a.deliverBatch(batch)
+			}
+			return
+		}
+		// the records buffered meanwhile wait for the next interval
+		for n := a.records.len(); n > 0; {
+			size := a.batchSize()
+			if size > n {
+				size = n
+			}
+			batch := a.records.take(size, a.MaxBatchBytes)
+			if len(batch) == 0 {
+				break
+			}
+			n -= len(batch)
+			a.deliverBatch(batch)
+		}
+	}
+}
+
+// recordSize estimates the size of record in a batch delivered to Bearer, if MaxBatchBytes is set.
+// The encoding of the batch being larger, because of its metadata, sendToBearer still splits it if needed.
+func (a *Agent) recordSize(record ReportLog) int {
+	if a.MaxBatchBytes <= 0 {
+		return 0
+	}
+	encoded, err := json.Marshal(record)
+	if err != nil {
+		return 0
+	}
+	// the separator with the previous record
+	return len(encoded) + 1
+}
+
+func (a *Agent) batchSize() int {
+	if a.maxBatched > 0 {
+		return a.maxBatched
+	}
+	return 50
+}
+
+func (a *Agent) bufferSize() int {
+	if a.maxBuffered > 0 {
+		return a.maxBuffered
+	}
+	return 1000
+}
+
+func (a *Agent) flushInterval() time.Duration {
+	if a.flushPeriod > 0 {
+		return a.flushPeriod
+	}
+	return 100 * time.Millisecond
+}
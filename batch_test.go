@@ -0,0 +1,27 @@
+package bearer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAgent_BufferOverflows(t *testing.T) {
+	fb := &fakeBearer{}
+	agent := &Agent{SecretKey: "sk", Transport: fb, OperationalTransport: fb, maxBuffered: 5, flushPeriod: time.Hour}
+	for i := 0; i < 8; i++ {
+		agent.sendRecord(ReportLog{Type: RequestEnd, Path: "/sample"})
+	}
+	stats := agent.Stats()
+	assert.Equal(t, 3, stats.BufferOverflows)
+	assert.Equal(t, 3, stats.RecordsDropped)
+	assert.Equal(t, 5, stats.PendingRecords)
+
+	// nothing is delivered before the end of the flush interval, unless flushed
+	fb.waitLogs(t, 0)
+	require.NoError(t, agent.Flush())
+	fb.waitLogs(t, 5)
+	assert.Equal(t, 5, agent.Stats().RecordsSent)
+}
@@ -0,0 +1,68 @@
+// Package bearerotel forwards the records of a bearer.Agent to OpenTelemetry, as spans.
+//
+// It is a dedicated module, so that the agent does not depend on OpenTelemetry.
+package bearerotel
+
+import (
+	"context"
+	"time"
+
+	bearer "github.com/Bearer/bearer-go"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Sink implements the bearer.RecordSink interface, converting each record into a client span
+// exported by the tracer, i.e.:
+//
+//	agent.Sinks = append(agent.Sinks, bearerotel.NewSink(otel.Tracer("bearer")))
+type Sink struct {
+	tracer trace.Tracer
+}
+
+// NewSink returns a Sink creating spans with tracer.
+func NewSink(tracer trace.Tracer) *Sink {
+	return &Sink{tracer: tracer}
+}
+
+// Send implements the bearer.RecordSink interface
+func (s *Sink) Send(ctx context.Context, records []bearer.ReportLog) error {
+	for _, record := range records {
+		_, span := s.tracer.Start(ctx, record.Method+" "+record.Hostname,
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithTimestamp(milliseconds(record.StartedAt)),
+			trace.WithAttributes(attributes(record)...),
+		)
+		if record.Type != bearer.RequestEnd || record.StatusCode >= 500 {
+			span.SetStatus(codes.Error, string(record.Type))
+		}
+		span.End(trace.WithTimestamp(milliseconds(record.EndedAt)))
+	}
+	return nil
+}
+
+// attributes returns the attributes of the span of record, following the HTTP semantic conventions.
+func attributes(record bearer.ReportLog) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{
+		attribute.String("http.method", record.Method),
+		attribute.String("http.url", record.URL),
+		attribute.String("net.peer.name", record.Hostname),
+		attribute.String("bearer.record_type", string(record.Type)),
+	}
+	if record.StatusCode != 0 {
+		attrs = append(attrs, attribute.Int("http.status_code", record.StatusCode))
+	}
+	if record.RequestID != "" {
+		attrs = append(attrs, attribute.String("bearer.request_id", record.RequestID))
+	}
+	for k, v := range record.Tags {
+		attrs = append(attrs, attribute.String("bearer.tag."+k, v))
+	}
+	return attrs
+}
+
+// milliseconds returns the time of a record's timestamp.
+func milliseconds(ms int) time.Time {
+	return time.Unix(0, int64(ms)*int64(time.Millisecond))
+}
@@ -0,0 +1,63 @@
+package bearerotel
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	bearer "github.com/Bearer/bearer-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestSink(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	sink := NewSink(provider.Tracer("bearer"))
+
+	started := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	require.NoError(t, sink.Send(context.Background(), []bearer.ReportLog{
+		{
+			Type:       bearer.RequestEnd,
+			Method:     "GET",
+			Hostname:   "api.example.com",
+			URL:        "https://api.example.com/users?page=2",
+			StatusCode: 200,
+			StartedAt:  int(started.UnixNano() / 1000000),
+			EndedAt:    int(started.Add(150*time.Millisecond).UnixNano() / 1000000),
+			Tags:       map[string]string{"team": "billing"},
+		},
+		{
+			Type:      bearer.RequestError,
+			Method:    "POST",
+			Hostname:  "down.example.com",
+			URL:       "https://down.example.com/",
+			StartedAt: int(started.UnixNano() / 1000000),
+			EndedAt:   int(started.UnixNano() / 1000000),
+		},
+	}))
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 2)
+
+	assert.Equal(t, "GET api.example.com", spans[0].Name())
+	assert.Equal(t, trace.SpanKindClient, spans[0].SpanKind())
+	assert.True(t, started.Equal(spans[0].StartTime()))
+	assert.Equal(t, 150*time.Millisecond, spans[0].EndTime().Sub(spans[0].StartTime()))
+	assert.Subset(t, spans[0].Attributes(), []attribute.KeyValue{
+		attribute.String("http.method", "GET"),
+		attribute.String("http.url", "https://api.example.com/users?page=2"),
+		attribute.Int("http.status_code", 200),
+		attribute.String("bearer.tag.team", "billing"),
+	})
+	assert.Equal(t, codes.Unset, spans[0].Status().Code)
+
+	assert.Equal(t, "POST down.example.com", spans[1].Name())
+	assert.Equal(t, codes.Error, spans[1].Status().Code)
+	assert.Equal(t, string(bearer.RequestError), spans[1].Status().Description)
+}
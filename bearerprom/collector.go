@@ -0,0 +1,74 @@
+// Package bearerprom exposes the counters of a bearer.Agent as Prometheus metrics.
+//
+// It is a dedicated module, so that the agent does not depend on the Prometheus client.
+package bearerprom
+
+import (
+	"time"
+
+	bearer "github.com/Bearer/bearer-go"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Collector implements the prometheus.Collector interface for an agent.
+// Counters are read from the agent's Stats when collected.
+type Collector struct {
+	agent *bearer.Agent
+
+	recordsSent    *prometheus.Desc
+	recordsDropped *prometheus.Desc
+	deliveryErrors *prometheus.Desc
+	configUpdates  *prometheus.Desc
+	bufferDepth    *prometheus.Desc
+
+	deliveryDuration prometheus.Histogram
+}
+
+// NewCollector returns a Collector for agent.
+// To feed the delivery duration histogram, set the agent's DeliveryObserver
+// before it is used, i.e.:
+//
+//	collector := bearerprom.NewCollector(agent)
+//	agent.DeliveryObserver = collector.ObserveDelivery
+//	prometheus.MustRegister(collector)
+func NewCollector(agent *bearer.Agent) *Collector {
+	return &Collector{
+		agent:          agent,
+		recordsSent:    prometheus.NewDesc("bearer_records_sent_total", "Number of records successfully delivered to Bearer.", nil, nil),
+		recordsDropped: prometheus.NewDesc("bearer_records_dropped_total", "Number of records that could not be delivered.", nil, nil),
+		deliveryErrors: prometheus.NewDesc("bearer_delivery_errors_total", "Number of failed deliveries.", nil, nil),
+		configUpdates:  prometheus.NewDesc("bearer_config_updates_total", "Number of times the config was fetched.", nil, nil),
+		bufferDepth:    prometheus.NewDesc("bearer_buffer_depth", "Number of records waiting to be delivered.", nil, nil),
+		deliveryDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "bearer_delivery_duration_seconds",
+			Help:    "Duration of the deliveries to Bearer.",
+			Buckets: prometheus.DefBuckets,
+		}),
+	}
+}
+
+// ObserveDelivery records the duration of a delivery, it can be used as the agent's DeliveryObserver.
+func (c *Collector) ObserveDelivery(duration time.Duration, err error) {
+	c.deliveryDuration.Observe(duration.Seconds())
+}
+
+// Describe implements the prometheus.Collector interface
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.recordsSent
+	ch <- c.recordsDropped
+	ch <- c.deliveryErrors
+	ch <- c.configUpdates
+	ch <- c.bufferDepth
+	c.deliveryDuration.Describe(ch)
+}
+
+// Collect implements the prometheus.Collector interface
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.agent.Stats()
+	ch <- prometheus.MustNewConstMetric(c.recordsSent, prometheus.CounterValue, float64(stats.RecordsSent))
+	ch <- prometheus.MustNewConstMetric(c.recordsDropped, prometheus.CounterValue, float64(stats.RecordsDropped))
+	ch <- prometheus.MustNewConstMetric(c.deliveryErrors, prometheus.CounterValue, float64(stats.DeliveryErrors))
+	ch <- prometheus.MustNewConstMetric(c.configUpdates, prometheus.CounterValue, float64(stats.ConfigUpdates))
+	ch <- prometheus.MustNewConstMetric(c.bufferDepth, prometheus.GaugeValue, float64(stats.PendingRecords))
+	c.deliveryDuration.Collect(ch)
+}
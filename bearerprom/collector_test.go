@@ -0,0 +1,54 @@
+package bearerprom
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	bearer "github.com/Bearer/bearer-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+func TestCollector(t *testing.T) {
+	bearerAPI := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(strings.NewReader("{}"))}, nil
+	})
+	agent := &bearer.Agent{SecretKey: "sk", Transport: bearerAPI, OperationalTransport: bearerAPI, DisableBlocking: true, SynchronousDelivery: true}
+	collector := NewCollector(agent)
+	agent.DeliveryObserver = collector.ObserveDelivery
+
+	registry := prometheus.NewRegistry()
+	require.NoError(t, registry.Register(collector))
+
+	req, err := http.NewRequest("GET", "http://api.example.com/sample", nil)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err := agent.RoundTrip(req)
+		require.NoError(t, err)
+	}
+
+	ts := httptest.NewServer(promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	defer ts.Close()
+	resp, err := http.Get(ts.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	scraped := string(body)
+	assert.Contains(t, scraped, "bearer_records_sent_total 3\n")
+	assert.Contains(t, scraped, "bearer_records_dropped_total 0\n")
+	assert.Contains(t, scraped, "bearer_delivery_errors_total 0\n")
+	assert.Contains(t, scraped, "bearer_config_updates_total 0\n")
+	assert.Contains(t, scraped, "bearer_buffer_depth 0\n")
+	assert.Contains(t, scraped, "bearer_delivery_duration_seconds_count 3\n")
+}
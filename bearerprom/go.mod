@@ -0,0 +1,11 @@
+module github.com/Bearer/bearer-go/bearerprom
+
+go 1.13
+
+require (
+	github.com/Bearer/bearer-go v1.1.1
+	github.com/prometheus/client_golang v1.5.1
+	github.com/stretchr/testify v1.4.0
+)
+
+replace github.com/Bearer/bearer-go => ../
@@ -0,0 +1,82 @@
+package bearer
+
+import (
+	"sync"
+	"time"
+)
+
+// CircuitState is the state of the circuit breaker of the deliveries to Bearer, see Agent.CircuitBreakerThreshold.
+type CircuitState string
+
+const (
+	// CircuitClosed is the state of a working delivery: deliveries are attempted.
+	CircuitClosed CircuitState = "closed"
+	// CircuitOpen is the state after too many consecutive failures: deliveries are not attempted.
+	CircuitOpen CircuitState = "open"
+	// CircuitHalfOpen is the state after the cooldown: a single delivery is attempted to test the recovery.
+	CircuitHalfOpen CircuitState = "half-open"
+)
+
+// circuitBreaker suspends the deliveries after consecutive failures.
+type circuitBreaker struct {
+	mutex    sync.Mutex
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// allow returns true if a delivery can be attempted at now.
+// Once the cooldown has elapsed, only one delivery at a time is allowed, until one succeeds.
+func (b *circuitBreaker) allow(now time.Time, cooldown time.Duration) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.openedAt.IsZero() {
+		return true
+	}
+	if now.Sub(b.openedAt) < cooldown || b.probing {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// done records the result of a delivery allowed at now, and returns true if it opened the circuit.
+func (b *circuitBreaker) done(now time.Time, failed bool, threshold int) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if !failed {
+		b.failures = 0
+		b.openedAt = time.Time{}
+		b.probing = false
+		return false
+	}
+	b.failures++
+	if b.probing || b.openedAt.IsZero() && b.failures >= threshold {
+		// the recovery test failed, or too many deliveries failed in a row
+		b.openedAt = now
+		b.probing = false
+		return true
+	}
+	return false
+}
+
+// cancel releases a delivery allowed but not attempted, so that another one can test the recovery.
+func (b *circuitBreaker) cancel() {
+	b.mutex.Lock()
+	b.probing = false
+	b.mutex.Unlock()
+}
+
+// state returns the state of the circuit at now.
+func (b *circuitBreaker) state(now time.Time, cooldown time.Duration) CircuitState {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	switch {
+	case b.openedAt.IsZero():
+		return CircuitClosed
+	case b.probing || now.Sub(b.openedAt) >= cooldown:
+		return CircuitHalfOpen
+	default:
+		return CircuitOpen
+	}
+}
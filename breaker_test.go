@@ -0,0 +1,83 @@
+package bearer
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAgent_CircuitBreaker(t *testing.T) {
+	var (
+		mutex    sync.Mutex
+		down     = true
+		attempts int
+	)
+	endpoint := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		attempts++
+		if down {
+			return fakeResponse(req, 503, "{}"), nil
+		}
+		return fakeResponse(req, 200, "{}"), nil
+	})
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	agent := &Agent{
+		SecretKey:               "sk",
+		Transport:               endpoint,
+		OperationalTransport:    endpoint,
+		Clock:                   clock,
+		SynchronousDelivery:     true,
+		CircuitBreakerThreshold: 3,
+		CircuitBreakerCooldown:  time.Minute,
+	}
+	send := func(n int) {
+		for i := 0; i < n; i++ {
+			agent.sendRecord(ReportLog{Type: RequestEnd, Path: "/sample"})
+		}
+	}
+	advance := func(d time.Duration) {
+		clock.mutex.Lock()
+		clock.now = clock.now.Add(d)
+		clock.mutex.Unlock()
+	}
+	assertAttempts := func(expected int) {
+		t.Helper()
+		mutex.Lock()
+		defer mutex.Unlock()
+		assert.Equal(t, expected, attempts)
+	}
+
+	send(2)
+	assert.Equal(t, CircuitClosed, agent.Stats().CircuitState)
+	send(1)
+	assert.Equal(t, CircuitOpen, agent.Stats().CircuitState)
+	assertAttempts(3)
+
+	// no delivery is attempted while the circuit is open
+	send(5)
+	assertAttempts(3)
+	assert.Equal(t, 8, agent.Stats().RecordsDropped)
+
+	// a failed recovery test opens the circuit again
+	advance(time.Minute)
+	assert.Equal(t, CircuitHalfOpen, agent.Stats().CircuitState)
+	send(1)
+	assertAttempts(4)
+	assert.Equal(t, CircuitOpen, agent.Stats().CircuitState)
+	send(1)
+	assertAttempts(4)
+
+	advance(time.Minute)
+	mutex.Lock()
+	down = false
+	mutex.Unlock()
+	send(2)
+	assertAttempts(6)
+	stats := agent.Stats()
+	assert.Equal(t, CircuitClosed, stats.CircuitState)
+	assert.Equal(t, 2, stats.RecordsSent)
+}
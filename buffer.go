@@ -0,0 +1,70 @@
+package bearer
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// maxPooledBufferSize is the capacity above which buffers are not returned to the pool,
+// so that a few large bodies do not keep a lot of memory alive.
+const maxPooledBufferSize = 1 << 20
+
+// bufferPool holds the buffers used to read and decode bodies, see PoolBuffers.
+var bufferPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+func getBuffer() *bytes.Buffer {
+	return bufferPool.Get().(*bytes.Buffer)
+}
+
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBufferSize {
+		return
+	}
+	buf.Reset()
+	bufferPool.Put(buf)
+}
+
+// readBody reads r until EOF, like ioutil.ReadAll.
+// If pool is true, r is read into a pooled buffer, and only the returned copy (of the exact size) is allocated.
+func readBody(r io.Reader, pool bool) ([]byte, error) {
+	if !pool {
+		return ioutil.ReadAll(r)
+	}
+	buf := getBuffer()
+	defer putBuffer(buf)
+	_, err := buf.ReadFrom(r)
+	// the pooled buffer is reused by other requests, so the body must never reference it
+	ret := make([]byte, buf.Len())
+	copy(ret, buf.Bytes())
+	return ret, err
+}
+
+// decodeBodyString returns the body decompressed by decodeBody, as a string.
+// If pool is true, it is decompressed into a pooled buffer, which is released once copied to the string.
+func decodeBodyString(body []byte, encoding string, pool bool) (string, error) {
+	if !pool {
+		decoded, err := decodeBody(body, encoding)
+		if err != nil {
+			return "", err
+		}
+		return string(decoded), nil
+	}
+	reader, err := bodyDecoder(body, encoding)
+	if err != nil {
+		return "", err
+	}
+	if reader == nil {
+		return string(body), nil
+	}
+	defer reader.Close()
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if _, err := buf.ReadFrom(reader); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,40 @@
+package bearer
+
+import (
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// packagePath is the import path of this package, used to recognize the agent's own frames.
+var packagePath = reflect.TypeOf(Agent{}).PkgPath()
+
+// callSite returns the "file:line" of the first caller outside of the agent and net/http,
+// i.e., the application code which made the request, or an empty string if there is none.
+func callSite() string {
+	pcs := make([]uintptr, 32)
+	// skip runtime.Callers and callSite
+	n := runtime.Callers(2, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+	for {
+		frame, more := frames.Next()
+		if !isInternalFrame(frame) {
+			return frame.File + ":" + strconv.Itoa(frame.Line)
+		}
+		if !more {
+			return ""
+		}
+	}
+}
+
+// isInternalFrame returns true for the frames of the agent (except its tests) and of net/http.
+func isInternalFrame(frame runtime.Frame) bool {
+	if strings.HasPrefix(frame.Function, "net/http.") {
+		return true
+	}
+	if strings.HasPrefix(frame.Function, packagePath+".") {
+		return !strings.HasSuffix(frame.File, "_test.go")
+	}
+	return false
+}
@@ -0,0 +1,12 @@
+package bearer
+
+import "time"
+
+// Clock returns the current time, it allows controlling time in tests.
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
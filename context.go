@@ -0,0 +1,79 @@
+package bearer
+
+import (
+	"context"
+	"io"
+	"net/http"
+)
+
+// UnlimitedBodySize is the size given to ContextWithMaxBodySize to capture whole bodies.
+const UnlimitedBodySize = -1
+
+type maxBodySizeKey struct{}
+
+// ContextWithMaxBodySize returns a copy of ctx in which the recorded bodies of requests are truncated
+// to n bytes, overriding Agent.MaxBodySize, i.e., to fully capture a request while debugging.
+// If n is UnlimitedBodySize (or any n <= 0), bodies are not truncated.
+func ContextWithMaxBodySize(ctx context.Context, n int) context.Context {
+	return context.WithValue(ctx, maxBodySizeKey{}, n)
+}
+
+// maxBodySize returns the size the bodies of req are truncated to, or zero if they are not truncated.
+func (a *Agent) maxBodySize(req *http.Request) int {
+	if n, ok := req.Context().Value(maxBodySizeKey{}).(int); ok {
+		if n <= 0 {
+			return 0
+		}
+		return n
+	}
+	return a.MaxBodySize
+}
+
+type attemptKey struct{}
+
+// ContextWithAttempt returns a copy of ctx in which requests are recorded as the attempt n (starting at 1)
+// of a request retried by the application, i.e., to analyze retry storms. The records of the attempts
+// can also be linked by their CorrelationID, by sending the same CorrelationIDHeader value on each attempt.
+func ContextWithAttempt(ctx context.Context, n int) context.Context {
+	return context.WithValue(ctx, attemptKey{}, n)
+}
+
+// attempt returns the attempt number of req set with ContextWithAttempt, or zero.
+func attempt(req *http.Request) int {
+	n, _ := req.Context().Value(attemptKey{}).(int)
+	return n
+}
+
+// roundTripWithTimeout performs the round trip of req, which has no deadline, with DefaultRequestTimeout.
+// The timeout also covers reading the response body, so it is released once the body is read or closed.
+// It does not apply to upgraded connections, which are returned untouched.
+func (a *Agent) roundTripWithTimeout(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(req.Context(), a.DefaultRequestTimeout)
+	resp, err := a.RoundTrip(req.WithContext(ctx))
+	if err != nil || resp == nil || resp.Body == nil || isUpgrade(req, resp) {
+		cancel()
+		return resp, err
+	}
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// cancelBody is a body calling cancel once it has been fully read or closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.cancel()
+	}
+	return n, err
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
@@ -1,8 +1,58 @@
 package bearer
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 var (
 	// ErrBlockedDomain is raised when your program tries to make requests to a blacklisted domain.
 	ErrBlockedDomain = errors.New("bearer: blocked domain")
+
+	// ErrInvalidSecretKey is returned by ValidateSecretKey when Bearer rejects the SecretKey.
+	ErrInvalidSecretKey = errors.New("bearer: invalid secret key")
+
+	// ErrCircuitOpen is returned for the records not delivered to Bearer while the circuit breaker is open,
+	// see Agent.CircuitBreakerThreshold.
+	ErrCircuitOpen = errors.New("bearer: delivery circuit breaker open")
 )
+
+// BlockedDomainError is returned when a request is made to a blocked domain,
+// errors.Is(err, ErrBlockedDomain) returns true for it.
+type BlockedDomainError struct {
+	// Hostname is the hostname of the blocked request.
+	Hostname string
+	// Pattern is the entry of BlockedDomains which matched the request.
+	Pattern string
+}
+
+func (e *BlockedDomainError) Error() string {
+	return fmt.Sprintf("%s: %s (matched %q)", ErrBlockedDomain, e.Hostname, e.Pattern)
+}
+
+// Is makes errors.Is(err, ErrBlockedDomain) work.
+func (e *BlockedDomainError) Is(target error) bool {
+	return target == ErrBlockedDomain
+}
+
+// DeliveryError is returned when Bearer rejects the delivery of records,
+// i.e., because of an invalid SecretKey.
+type DeliveryError struct {
+	// StatusCode is the HTTP status code of Bearer's response.
+	StatusCode int
+	// Code is the error code sent by Bearer, if any.
+	Code string
+	// Message is the error message sent by Bearer, if any.
+	Message string
+}
+
+func (e *DeliveryError) Error() string {
+	switch {
+	case e.Message == "":
+		return fmt.Sprintf("unsupported status code: %d", e.StatusCode)
+	case e.Code == "":
+		return fmt.Sprintf("unsupported status code: %d: %s", e.StatusCode, e.Message)
+	default:
+		return fmt.Sprintf("unsupported status code: %d: %s (%s)", e.StatusCode, e.Message, e.Code)
+	}
+}
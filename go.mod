@@ -1,6 +1,6 @@
 module github.com/Bearer/bearer-go
 
-go 1.13
+go 1.15
 
 require (
 	github.com/stretchr/testify v1.4.0
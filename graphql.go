@@ -0,0 +1,69 @@
+package bearer
+
+import (
+	"encoding/json"
+	"regexp"
+)
+
+var (
+	// graphQLOperationName matches the name of the first operation of a query document
+	graphQLOperationName = regexp.MustCompile(`^\s*(?:query|mutation|subscription)\s+([_A-Za-z][_0-9A-Za-z]*)`)
+	// graphQLStringArgument matches the string literals given as arguments or input fields, i.e., password: "secret"
+	graphQLStringArgument = regexp.MustCompile(`([_A-Za-z][_0-9A-Za-z]*)(\s*:\s*)"(?:[^"\\]|\\.)*"`)
+)
+
+// isGraphQLRequest returns true if obj looks like a GraphQL request: a "query" string,
+// with "variables" or an "operationName". If graphQLPath is true, the query is enough.
+func isGraphQLRequest(obj map[string]interface{}, graphQLPath bool) bool {
+	if _, ok := obj["query"].(string); !ok {
+		return false
+	}
+	if graphQLPath {
+		return true
+	}
+	_, hasVariables := obj["variables"]
+	_, hasOperationName := obj["operationName"]
+	return hasVariables || hasOperationName
+}
+
+// graphQLOperation returns the operation name of a GraphQL request body, if any.
+func graphQLOperation(body string, graphQLPath bool) string {
+	var obj map[string]interface{}
+	if err := json.Unmarshal([]byte(body), &obj); err != nil || !isGraphQLRequest(obj, graphQLPath) {
+		return ""
+	}
+	if name, ok := obj["operationName"].(string); ok && name != "" {
+		return name
+	}
+	if match := graphQLOperationName.FindStringSubmatch(obj["query"].(string)); match != nil {
+		return match[1]
+	}
+	return ""
+}
+
+// sanitizeGraphQL redacts the sensitive arguments written inline in the query of a GraphQL request,
+// and the variables sent as an encoded JSON string. Variables sent as an object are redacted with the
+// rest of the body.
+func (s regexSanitizer) sanitizeGraphQL(obj map[string]interface{}) {
+	query := obj["query"].(string)
+	obj["query"] = graphQLStringArgument.ReplaceAllStringFunc(query, func(match string) string {
+		parts := graphQLStringArgument.FindStringSubmatch(match)
+		if !s.sensitiveKey(parts[1]) {
+			return match
+		}
+		return parts[1] + parts[2] + `"` + s.placeholder + `"`
+	})
+
+	encoded, ok := obj["variables"].(string)
+	if !ok {
+		return
+	}
+	var variables map[string]interface{}
+	if err := json.Unmarshal([]byte(encoded), &variables); err != nil {
+		return
+	}
+	s.sanitizeJSONObject(variables, "variables")
+	if out, err := json.Marshal(variables); err == nil {
+		obj["variables"] = string(out)
+	}
+}
@@ -0,0 +1,101 @@
+package bearer
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// isGRPC returns true if the request is a gRPC call (application/grpc, application/grpc+proto, etc).
+func isGRPC(req *http.Request) bool {
+	return strings.HasPrefix(strings.ToLower(req.Header.Get("Content-Type")), "application/grpc")
+}
+
+// grpcStatus returns the value of the grpc-status header or trailer, if any.
+// For "trailers-only" responses, grpc-status is sent as a regular header.
+func grpcStatus(resp *http.Response) (int, bool) {
+	if resp == nil {
+		return 0, false
+	}
+	value := resp.Trailer.Get("Grpc-Status")
+	if value == "" {
+		value = resp.Header.Get("Grpc-Status")
+	}
+	if value == "" {
+		return 0, false
+	}
+	status, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, false
+	}
+	return status, true
+}
+
+// deferredBody counts the bytes read, and calls done with their count once the body has been fully read
+// or closed, which is when the response trailers become available, with ended set.
+// If neither happens before the timeout, i.e., the body is never closed, done is called anyway.
+type deferredBody struct {
+	io.ReadCloser
+	done  func(read int, ended bool)
+	once  sync.Once
+	timer *time.Timer
+	read  int64
+}
+
+func newDeferredBody(body io.ReadCloser, timeout time.Duration, done func(read int, ended bool)) *deferredBody {
+	b := &deferredBody{ReadCloser: body, done: done}
+	b.timer = time.AfterFunc(timeout, func() { b.once.Do(func() { b.done(b.count(), false) }) })
+	return b
+}
+
+func (b *deferredBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	atomic.AddInt64(&b.read, int64(n))
+	if err == io.EOF {
+		b.end()
+	}
+	return n, err
+}
+
+func (b *deferredBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.end()
+	return err
+}
+
+func (b *deferredBody) end() {
+	b.timer.Stop()
+	b.once.Do(func() { b.done(b.count(), true) })
+}
+
+func (b *deferredBody) count() int {
+	return int(atomic.LoadInt64(&b.read))
+}
+
+func (a *Agent) deferredTimeout() time.Duration {
+	if a.bodyTimeout > 0 {
+		return a.bodyTimeout
+	}
+	return time.Minute
+}
+
+// streamedBody counts the bytes read from a request body without buffering it,
+// as the transport may still be streaming it while the response is received.
+type streamedBody struct {
+	io.ReadCloser
+	read int64
+}
+
+func (b *streamedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	atomic.AddInt64(&b.read, int64(n))
+	return n, err
+}
+
+func (b *streamedBody) count() int {
+	return int(atomic.LoadInt64(&b.read))
+}
@@ -0,0 +1,42 @@
+package bearer
+
+import "strings"
+
+// HostSettings overrides the agent-wide settings for the requests to some hosts.
+type HostSettings struct {
+	// If true, request and response bodies are never captured.
+	SkipBodies bool
+
+	// If set, the fraction of requests that are recorded, between 0 and 1.
+	// If zero, the agent-wide SampleRate is used.
+	SampleRate float64
+
+	// If true, records are not sanitized.
+	// Only use this for trusted hosts whose traffic contains no sensitive data.
+	DisableSanitization bool
+}
+
+// hostSettings returns the settings for a hostname.
+// Exact matches take precedence over wildcard patterns ("*.example.com"),
+// and longer wildcard patterns take precedence over shorter ones.
+func (a *Agent) hostSettings(hostname string) HostSettings {
+	if len(a.Hosts) == 0 {
+		return HostSettings{}
+	}
+	hostname = strings.ToLower(hostname)
+	var (
+		settings HostSettings
+		matched  string
+	)
+	for pattern, candidate := range a.Hosts {
+		pattern = strings.ToLower(pattern)
+		if pattern == hostname {
+			return candidate
+		}
+		if strings.HasPrefix(pattern, "*.") && strings.HasSuffix(hostname, pattern[1:]) && len(pattern) > len(matched) {
+			settings = candidate
+			matched = pattern
+		}
+	}
+	return settings
+}
@@ -0,0 +1,80 @@
+package bearer
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAgent_Hosts(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"password":"hunter2"}`))
+	}))
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	require.NoError(t, err)
+
+	fb := &fakeBearer{}
+	agent := &Agent{
+		SecretKey:            "sk",
+		Transport:            fb,
+		OperationalTransport: fb,
+		SynchronousDelivery:  true,
+		Hosts: map[string]HostSettings{
+			"localhost": {SkipBodies: true},
+			"127.0.0.1": {DisableSanitization: true},
+		},
+	}
+	client := &http.Client{Transport: agent}
+	for _, host := range []string{"localhost", "127.0.0.1"} {
+		resp, err := client.Post("http://"+host+":"+u.Port()+"/", "application/json", strings.NewReader(`{"hello":"world"}`))
+		require.NoError(t, err)
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+
+	logs := fb.waitLogs(t, 2)
+	assert.Equal(t, "localhost", logs[0].Hostname)
+	assert.Empty(t, logs[0].RequestBody)
+	assert.Empty(t, logs[0].ResponseBody)
+	assert.Equal(t, "127.0.0.1", logs[1].Hostname)
+	assert.Equal(t, `{"hello":"world"}`, logs[1].RequestBody)
+	assert.Equal(t, `{"password":"hunter2"}`, logs[1].ResponseBody)
+}
+
+func TestAgent_hostSettings(t *testing.T) {
+	agent := &Agent{Hosts: map[string]HostSettings{
+		"api.example.com":        {SampleRate: 0.1},
+		"*.example.com":          {SampleRate: 0.2},
+		"*.internal.example.com": {SampleRate: 0.3},
+	}}
+	assert.Equal(t, 0.1, agent.hostSettings("api.example.com").SampleRate)
+	assert.Equal(t, 0.1, agent.hostSettings("API.example.com").SampleRate)
+	assert.Equal(t, 0.2, agent.hostSettings("www.example.com").SampleRate)
+	assert.Equal(t, 0.3, agent.hostSettings("db.internal.example.com").SampleRate)
+	assert.Equal(t, 0.0, agent.hostSettings("example.com").SampleRate)
+	assert.Equal(t, 0.0, agent.hostSettings("example.org").SampleRate)
+}
+
+func TestAgent_SampleRate(t *testing.T) {
+	req, err := http.NewRequest("GET", "http://sampled.example.com/", nil)
+	require.NoError(t, err)
+	agent := &Agent{
+		SampleRate: 0.000001,
+		Hosts:      map[string]HostSettings{"all.example.com": {SampleRate: 1}},
+	}
+	for i := 0; i < 100; i++ {
+		assert.False(t, agent.shouldRecord(req, nil))
+	}
+	req.URL.Host = "all.example.com"
+	for i := 0; i < 100; i++ {
+		assert.True(t, agent.shouldRecord(req, nil))
+	}
+}
@@ -0,0 +1,75 @@
+package bearer
+
+import (
+	"sort"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// LeveledLogger is a minimal leveled logging interface.
+// It is implemented by the standard library's *slog.Logger,
+// which allows using the agent without configuring a zap.Logger.
+type LeveledLogger interface {
+	Debug(msg string, keysAndValues ...interface{})
+	Info(msg string, keysAndValues ...interface{})
+	Warn(msg string, keysAndValues ...interface{})
+	Error(msg string, keysAndValues ...interface{})
+}
+
+// newLeveledZapLogger returns a zap.Logger forwarding its entries to a LeveledLogger.
+func newLeveledZapLogger(logger LeveledLogger) *zap.Logger {
+	return zap.New(leveledCore{logger: logger})
+}
+
+// leveledCore is a zapcore.Core forwarding entries to a LeveledLogger.
+type leveledCore struct {
+	logger LeveledLogger
+	fields []zapcore.Field
+}
+
+func (leveledCore) Enabled(zapcore.Level) bool { return true }
+
+func (c leveledCore) With(fields []zapcore.Field) zapcore.Core {
+	return leveledCore{
+		logger: c.logger,
+		fields: append(append([]zapcore.Field{}, c.fields...), fields...),
+	}
+}
+
+func (c leveledCore) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	return checked.AddCore(entry, c)
+}
+
+func (c leveledCore) Write(entry zapcore.Entry, fields []zapcore.Field) error {
+	encoder := zapcore.NewMapObjectEncoder()
+	for _, field := range c.fields {
+		field.AddTo(encoder)
+	}
+	for _, field := range fields {
+		field.AddTo(encoder)
+	}
+	keys := make([]string, 0, len(encoder.Fields))
+	for key := range encoder.Fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	keysAndValues := make([]interface{}, 0, len(keys)*2)
+	for _, key := range keys {
+		keysAndValues = append(keysAndValues, key, encoder.Fields[key])
+	}
+
+	switch {
+	case entry.Level <= zapcore.DebugLevel:
+		c.logger.Debug(entry.Message, keysAndValues...)
+	case entry.Level == zapcore.InfoLevel:
+		c.logger.Info(entry.Message, keysAndValues...)
+	case entry.Level == zapcore.WarnLevel:
+		c.logger.Warn(entry.Message, keysAndValues...)
+	default:
+		c.logger.Error(entry.Message, keysAndValues...)
+	}
+	return nil
+}
+
+func (leveledCore) Sync() error { return nil }
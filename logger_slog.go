@@ -0,0 +1,9 @@
+//go:build go1.21
+// +build go1.21
+
+package bearer
+
+import "log/slog"
+
+// the standard library's *slog.Logger can be used as Agent.LeveledLogger
+var _ LeveledLogger = (*slog.Logger)(nil)
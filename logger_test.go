@@ -0,0 +1,60 @@
+//go:build go1.21
+// +build go1.21
+
+package bearer
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingHandler is a slog.Handler keeping the records it receives.
+type recordingHandler struct {
+	mutex   sync.Mutex
+	records []slog.Record
+}
+
+func (h *recordingHandler) Enabled(context.Context, slog.Level) bool { return true }
+func (h *recordingHandler) WithAttrs([]slog.Attr) slog.Handler       { return h }
+func (h *recordingHandler) WithGroup(string) slog.Handler            { return h }
+
+func (h *recordingHandler) Handle(_ context.Context, record slog.Record) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.records = append(h.records, record)
+	return nil
+}
+
+type failingSanitizer struct{}
+
+func (failingSanitizer) Sanitize(*ReportLog) error { return errors.New("boom") }
+
+func TestAgent_LeveledLogger(t *testing.T) {
+	handler := &recordingHandler{}
+	agent := &Agent{LeveledLogger: slog.New(handler), Sanitizer: failingSanitizer{}}
+
+	req, err := http.NewRequest("GET", "http://api.example.com/sample", nil)
+	require.NoError(t, err)
+	agent.newRecord(req, &http.Response{StatusCode: 200}, time.Now(), time.Now(), nil, nil)
+
+	handler.mutex.Lock()
+	defer handler.mutex.Unlock()
+	require.Len(t, handler.records, 1)
+	record := handler.records[0]
+	assert.Equal(t, slog.LevelWarn, record.Level)
+	assert.Equal(t, "sanitize record", record.Message)
+	attrs := map[string]string{}
+	record.Attrs(func(attr slog.Attr) bool {
+		attrs[attr.Key] = attr.Value.String()
+		return true
+	})
+	assert.Equal(t, map[string]string{"error": "boom"}, attrs)
+}
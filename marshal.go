@@ -0,0 +1,100 @@
+package bearer
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime"
+)
+
+const (
+	// SchemaVersion1 is the schema of the logs requests with secretKey, runtime, agent and logs fields.
+	SchemaVersion1 = 1
+
+	// DefaultSchemaVersion is the schema version of the logs requests if Agent.SchemaVersion is not set.
+	DefaultSchemaVersion = SchemaVersion1
+)
+
+// schemaMarshalers encode the logs requests of each supported schema version, as JSON.
+var schemaMarshalers = map[int]func(records []ReportLog, meta LogsMetadata) interface{}{
+	SchemaVersion1: logsRequestV1,
+}
+
+// LogsMetadata describes the agent delivering a batch of records.
+type LogsMetadata struct {
+	SecretKey      string
+	RuntimeType    string
+	RuntimeVersion string
+	AgentType      string
+	AgentVersion   string
+	LogLevel       string
+	SchemaVersion  int
+}
+
+// Marshaler encodes a batch of records for delivery to Bearer,
+// and returns the body of the logs request and its content type.
+type Marshaler func(records []ReportLog, meta LogsMetadata) ([]byte, string, error)
+
+// newLogsMetadata returns the metadata of the batches delivered by the agent.
+func (a *Agent) newLogsMetadata() LogsMetadata {
+	return LogsMetadata{
+		SecretKey:      a.SecretKey,
+		RuntimeType:    "go",
+		RuntimeVersion: runtime.Version(),
+		AgentType:      "bearer-go",
+		AgentVersion:   version,
+		LogLevel:       "ALL",
+		SchemaVersion:  a.schemaVersion(),
+	}
+}
+
+// schemaVersion returns the schema version of the logs requests.
+func (a *Agent) schemaVersion() int {
+	if a.SchemaVersion == 0 {
+		return DefaultSchemaVersion
+	}
+	return a.SchemaVersion
+}
+
+// JSONMarshaler is the default Marshaler, encoding batches as expected by Bearer's API,
+// in the schema version of the metadata.
+func JSONMarshaler(records []ReportLog, meta LogsMetadata) ([]byte, string, error) {
+	schemaVersion := meta.SchemaVersion
+	if schemaVersion == 0 {
+		schemaVersion = DefaultSchemaVersion
+	}
+	newRequest, ok := schemaMarshalers[schemaVersion]
+	if !ok {
+		return nil, "", fmt.Errorf("unsupported schema version: %d", schemaVersion)
+	}
+	out, err := json.Marshal(newRequest(records, meta))
+	if err != nil {
+		return nil, "", err
+	}
+	return out, "application/json", nil
+}
+
+// logsRequestV1 returns the logs request of SchemaVersion1.
+func logsRequestV1(records []ReportLog, meta LogsMetadata) interface{} {
+	type logsRequest struct {
+		SchemaVersion int    `json:"schemaVersion"`
+		SecretKey     string `json:"secretKey"`
+		Runtime       struct {
+			Type    string `json:"type"`
+			Version string `json:"version"`
+		} `json:"runtime"`
+		Agent struct {
+			Type     string `json:"type"`
+			Version  string `json:"version"`
+			LogLevel string `json:"log_level"`
+			// FIXME: Config
+		} `json:"agent"`
+		Logs []ReportLog `json:"logs"`
+	}
+	input := logsRequest{SchemaVersion: SchemaVersion1, SecretKey: meta.SecretKey, Logs: records}
+	input.Runtime.Type = meta.RuntimeType
+	input.Runtime.Version = meta.RuntimeVersion
+	input.Agent.Type = meta.AgentType
+	input.Agent.Version = meta.AgentVersion
+	input.Agent.LogLevel = meta.LogLevel
+	return input
+}
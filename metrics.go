@@ -0,0 +1,16 @@
+package bearer
+
+import (
+	"expvar"
+	"fmt"
+)
+
+// PublishExpvar publishes the agent's Stats to expvar under the given name,
+// i.e., "bearer". Publishing is opt-in, nothing is registered by default.
+func (a *Agent) PublishExpvar(name string) error {
+	if expvar.Get(name) != nil {
+		return fmt.Errorf("bearer: expvar %q is already published", name)
+	}
+	expvar.Publish(name, expvar.Func(func() interface{} { return a.Stats() }))
+	return nil
+}
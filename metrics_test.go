@@ -0,0 +1,34 @@
+package bearer
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAgent_PublishExpvar(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer ts.Close()
+
+	fb := &fakeBearer{}
+	agent := &Agent{SecretKey: "sk", Transport: fb, OperationalTransport: fb}
+	require.NoError(t, agent.PublishExpvar("bearer-test"))
+	require.Error(t, agent.PublishExpvar("bearer-test"))
+
+	client := &http.Client{Transport: agent}
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(ts.URL)
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+	fb.waitLogs(t, 2)
+
+	var stats Stats
+	require.NoError(t, json.Unmarshal([]byte(expvar.Get("bearer-test").String()), &stats))
+	assert.Equal(t, Stats{RecordsSent: 2, ConfigUpdates: 1}, stats)
+}
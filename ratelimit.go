@@ -0,0 +1,43 @@
+package bearer
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// rateLimiter spaces events so that at most perSecond happen per second.
+type rateLimiter struct {
+	mutex sync.Mutex
+	next  time.Time
+}
+
+// wait blocks until an event is allowed, or until ctx is done.
+func (l *rateLimiter) wait(ctx context.Context, perSecond float64) error {
+	if perSecond <= 0 {
+		return nil
+	}
+	interval := time.Duration(float64(time.Second) / perSecond)
+
+	l.mutex.Lock()
+	now := time.Now()
+	slot := l.next
+	if slot.Before(now) {
+		slot = now
+	}
+	l.next = slot.Add(interval)
+	l.mutex.Unlock()
+
+	delay := slot.Sub(now)
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
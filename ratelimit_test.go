@@ -0,0 +1,66 @@
+package bearer
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAgent_MaxDeliveriesPerSecond(t *testing.T) {
+	fb := &fakeBearer{}
+	var (
+		mutex      sync.Mutex
+		deliveries int
+	)
+	transport := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Hostname() == "agent.bearer.sh" {
+			mutex.Lock()
+			deliveries++
+			mutex.Unlock()
+		}
+		return fb.RoundTrip(req)
+	})
+	agent := &Agent{SecretKey: "sk", Transport: transport, OperationalTransport: transport, MaxDeliveriesPerSecond: 20, maxBatched: 1}
+	for i := 0; i < 30; i++ {
+		agent.sendRecord(ReportLog{Type: RequestEnd, Path: "/sample"})
+	}
+
+	time.Sleep(500 * time.Millisecond)
+	mutex.Lock()
+	delivered := deliveries
+	mutex.Unlock()
+	assert.True(t, delivered >= 5 && delivered <= 11, "%d deliveries", delivered)
+	// the other records wait in the buffer
+	assert.True(t, agent.BufferLen() >= 18, "%d buffered records", agent.BufferLen())
+
+	fb.waitLogs(t, 30)
+}
+
+func TestAgent_MaxDeliveriesPerSecond_Batches(t *testing.T) {
+	fb := &fakeBearer{}
+	var (
+		mutex      sync.Mutex
+		deliveries int
+	)
+	transport := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Hostname() == "agent.bearer.sh" {
+			mutex.Lock()
+			deliveries++
+			mutex.Unlock()
+		}
+		return fb.RoundTrip(req)
+	})
+	agent := &Agent{SecretKey: "sk", Transport: transport, OperationalTransport: transport, MaxDeliveriesPerSecond: 2}
+	for i := 0; i < 150; i++ {
+		agent.sendRecord(ReportLog{Type: RequestEnd, Path: "/sample"})
+	}
+
+	// the records accumulated while waiting are delivered by fewer requests
+	fb.waitLogs(t, 150)
+	mutex.Lock()
+	defer mutex.Unlock()
+	assert.True(t, deliveries <= 3, "%d deliveries", deliveries)
+}
@@ -0,0 +1,64 @@
+package bearer
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net/http"
+)
+
+// redirectHop identifies a request in a chain of redirects followed by an http.Client.
+type redirectHop struct {
+	id    string
+	index int
+}
+
+// redirectBody carries the redirect hop of a redirect response, so the agent can link
+// the next request, which references this response in its Response field.
+type redirectBody struct {
+	io.ReadCloser
+	hop *redirectHop
+}
+
+// followRedirect returns the redirect hop of a request, or nil if the request neither
+// follows a redirect nor got a redirect response.
+func followRedirect(req *http.Request, resp *http.Response) *redirectHop {
+	if req.Response != nil {
+		body := req.Response.Body
+		// with DefaultRequestTimeout, the redirect body is wrapped to release the timeout
+		if cancel, ok := body.(*cancelBody); ok {
+			body = cancel.ReadCloser
+		}
+		if body, ok := body.(*redirectBody); ok {
+			return &redirectHop{id: body.hop.id, index: body.hop.index + 1}
+		}
+	}
+	if !isRedirect(resp) {
+		return nil
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil
+	}
+	return &redirectHop{id: hex.EncodeToString(id), index: 1}
+}
+
+// isRedirect returns true if resp is a redirect that an http.Client may follow.
+func isRedirect(resp *http.Response) bool {
+	if resp == nil || resp.Header.Get("Location") == "" {
+		return false
+	}
+	switch resp.StatusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	default:
+		return false
+	}
+}
+
+// apply copies the redirect hop to the record.
+func (h *redirectHop) apply(record *ReportLog) {
+	record.RedirectID = h.id
+	record.RedirectHop = h.index
+}
@@ -0,0 +1,209 @@
+package bearer
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// safeRoundTrip performs the round trip without doing any of the agent's work before returning, see SafeMode.
+// The bodies are copied while the transport and the application read them, and the request is recorded
+// in the background once the response body has been fully read or closed.
+func (a *Agent) safeRoundTrip(req *http.Request) (resp *http.Response, roundtripError error) {
+	var (
+		blocked       error
+		excluded      bool
+		reqBody       *captureBody
+		site          string
+		correlationID string
+		trace         *requestTrace
+	)
+	a.protect(func() {
+		blocked = a.blockedDomain(req)
+		excluded = matchPaths(a.ExcludePaths, req.URL.Path) || !a.isAvailable()
+	})
+	if blocked != nil {
+		return nil, blocked
+	}
+	if excluded {
+		return a.transport().RoundTrip(req)
+	}
+	a.protect(func() {
+		if req.Body != nil && req.Body != http.NoBody && isParseableContentType.MatchString(req.Header.Get("Content-Type")) {
+			reqBody = &captureBody{ReadCloser: req.Body, limit: a.captureLimit(req, false)}
+			req.Body = reqBody
+		}
+		req, correlationID = a.correlate(req)
+		if a.CaptureCallSite {
+			site = callSite()
+		}
+		if a.CaptureAddrs || a.CaptureDNS {
+			trace = &requestTrace{addrs: a.CaptureAddrs, dns: a.CaptureDNS}
+			req = trace.withTrace(req)
+		}
+	})
+
+	start := a.clock().Now()
+	resp, roundtripError = a.transport().RoundTrip(req)
+	end := a.clock().Now()
+
+	record := func(resp *http.Response) {
+		go a.protect(func() {
+			a.recordRoundTrip(req, resp, start, end, reqBody, roundtripError, site, correlationID, trace)
+		})
+	}
+	var wrap bool
+	a.protect(func() {
+		// upgraded connections are returned untouched, and bodies which are not captured are not copied
+		wrap = resp != nil && resp.Body != nil && !isUpgrade(req, resp) &&
+			isParseableContentType.MatchString(resp.Header.Get("Content-Type"))
+	})
+	if !wrap {
+		if resp == nil {
+			record(nil)
+			return resp, roundtripError
+		}
+		// the application keeps the original response, and may read its body meanwhile
+		snapshot := *resp
+		snapshot.Header = resp.Header.Clone()
+		snapshot.Body = nil
+		record(&snapshot)
+		return resp, roundtripError
+	}
+	body := &captureBody{ReadCloser: resp.Body, limit: a.captureLimit(req, true)}
+	body.done = func() {
+		// the application keeps the original response
+		snapshot := *resp
+		snapshot.Body = ioutil.NopCloser(bytes.NewReader(body.bytes()))
+		// the size of the whole body, which may not be entirely copied
+		snapshot.ContentLength = int64(body.size())
+		record(&snapshot)
+	}
+	resp.Body = body
+	return resp, roundtripError
+}
+
+// recordRoundTrip records a round trip performed in SafeMode.
+func (a *Agent) recordRoundTrip(req *http.Request, resp *http.Response, start, end time.Time, reqBody *captureBody, roundtripError error, site, correlationID string, trace *requestTrace) {
+	cancelled := isCancellation(req, roundtripError)
+	if cancelled && !a.RecordCancellations || !a.shouldRecord(req, resp) {
+		return
+	}
+	var body []byte
+	if reqBody != nil {
+		body = reqBody.bytes()
+	}
+	record := a.newRecord(req, resp, start, end, body, roundtripError)
+	switch {
+	case cancelled:
+		record.Type = RequestCancelled
+	case roundtripError != nil:
+		record.Type = RequestError
+	}
+	// the bodies may not have been entirely copied, see captureLimit
+	switch {
+	case reqBody != nil:
+		record.BytesSent = reqBody.size()
+		if record.OriginalRequestBodySize > 0 && record.BytesSent > record.OriginalRequestBodySize {
+			record.OriginalRequestBodySize = record.BytesSent
+		}
+	case req.ContentLength > 0:
+		record.BytesSent = int(req.ContentLength)
+	}
+	if resp != nil && int(resp.ContentLength) > record.BytesReceived {
+		record.BytesReceived = int(resp.ContentLength)
+	}
+	if resp != nil && record.OriginalResponseBodySize > 0 && int(resp.ContentLength) > record.OriginalResponseBodySize {
+		record.OriginalResponseBodySize = int(resp.ContentLength)
+	}
+	record.CallSite = site
+	record.CorrelationID = correlationID
+	if trace != nil {
+		trace.apply(&record)
+	}
+	a.sendRecord(record)
+}
+
+// captureTruncationMargin is the number of bytes copied beyond MaxBodySize in SafeMode,
+// so that the values cut by the truncation are still seen whole by the sanitizer.
+const captureTruncationMargin = 4096
+
+// captureLimit returns the number of bytes of the request or response body of req copied in SafeMode,
+// or zero if the copy is not limited. One more byte than MaxCapturedResponseSize tells that
+// a response body exceeds it. Compressed bodies exceeding the limit can not be decoded, so are not captured.
+func (a *Agent) captureLimit(req *http.Request, response bool) int {
+	limit := 0
+	if max := a.maxBodySize(req); max > 0 {
+		limit = max + captureTruncationMargin
+	}
+	if response && a.MaxCapturedResponseSize > 0 && (limit == 0 || a.MaxCapturedResponseSize+1 < limit) {
+		limit = a.MaxCapturedResponseSize + 1
+	}
+	return limit
+}
+
+// protect calls fn, and logs its panic instead of propagating it.
+func (a *Agent) protect(fn func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			a.logger().Error("panic", zap.Any("r", r))
+		}
+	}()
+	fn()
+}
+
+// captureBody copies the bytes read from a body (up to limit, if positive),
+// and calls done (if set) once it has been fully read or closed.
+type captureBody struct {
+	io.ReadCloser
+	done  func()
+	once  sync.Once
+	limit int
+
+	mutex sync.Mutex
+	buf   bytes.Buffer
+	read  int
+}
+
+func (b *captureBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.mutex.Lock()
+	b.read += n
+	kept := p[:n]
+	if room := b.limit - b.buf.Len(); b.limit > 0 && room < len(kept) {
+		kept = kept[:room]
+	}
+	b.buf.Write(kept)
+	b.mutex.Unlock()
+	if err == io.EOF && b.done != nil {
+		b.once.Do(b.done)
+	}
+	return n, err
+}
+
+func (b *captureBody) Close() error {
+	err := b.ReadCloser.Close()
+	if b.done != nil {
+		b.once.Do(b.done)
+	}
+	return err
+}
+
+// bytes returns a copy of the bytes copied so far.
+func (b *captureBody) bytes() []byte {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return append([]byte{}, b.buf.Bytes()...)
+}
+
+// size returns the number of bytes read so far, including the ones not copied.
+func (b *captureBody) size() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.read
+}
@@ -1,90 +1,630 @@
 package bearer
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"net/url"
 	"regexp"
+	"regexp/syntax"
 	"strings"
 )
 
 const (
-	defaultStripSensitiveKeys   = `(?i)^authorization$|^password$|^secret$|^passwd$|^api.?key$|^access.?token$|^auth.?token$|^credentials$|^mysql_pwd$|^stripetoken$|^card.?number.?$|^secret$|^client.?id$|^client.?secret$`
-	defaultStripSensitiveRegex  = `[a-zA-Z0-9]{1}[a-zA-Z0-9.!#$%&’*+=?^_` + "`" + `{|}~-]+@[a-zA-Z0-9-]+(?:\\.[a-zA-Z0-9-]+)*|(?:\\d[ -]*?){13,16}`
-	defaultSensitivePlaceholder = `[FILTERED]`
+	defaultStripSensitiveKeys    = `(?i)^authorization$|^password$|^secret$|^passwd$|^api.?key$|^access.?token$|^auth.?token$|^credentials$|^mysql_pwd$|^stripetoken$|^card.?number.?$|^secret$|^client.?id$|^client.?secret$`
+	defaultStripSensitiveRegex   = `[a-zA-Z0-9]{1}[a-zA-Z0-9.!#$%&’*+=?^_` + "`" + `{|}~-]+@[a-zA-Z0-9-]+(?:\.[a-zA-Z0-9-]+)*|(?:\d[ -]*?){13,16}`
+	defaultStripSensitiveCookies = `(?i)sess|sid$|token|auth|jwt|csrf|xsrf|remember`
+	defaultSensitivePlaceholder  = `[FILTERED]`
 )
 
+// Sanitizer redacts sensitive data from records before they are sent to Bearer.
+type Sanitizer interface {
+	Sanitize(record *ReportLog) error
+}
+
+// SensitiveKeyProfile is a preset of key names (headers, query parameters, JSON keys and cookies)
+// whose values are redacted, in addition to the sensitive keys. Names are case-insensitive.
+// A profile can be extended with append, i.e., append(AWSSensitiveKeys, "X-My-Token").
+type SensitiveKeyProfile []string
+
+// RedactionProfile is a named preset of sensitive keys and values, see RedactionProfiles.
+type RedactionProfile struct {
+	// Keys whose values are redacted, in addition to the sensitive keys
+	Keys SensitiveKeyProfile
+	// Values redacted wherever they appear, in addition to the sensitive values
+	Values []*regexp.Regexp
+}
+
+// HeaderRule redacts the value of a header, see Agent.HeaderRules.
+type HeaderRule func(value string) string
+
+// KeepPrefix returns a HeaderRule keeping the first n characters of values, i.e., "sk_l[FILTERED]"
+// with n = 4, which allows identifying an API key without recording it.
+// Values of n characters or less are entirely redacted.
+func KeepPrefix(n int) HeaderRule {
+	return func(value string) string {
+		runes := []rune(value)
+		if len(runes) <= n {
+			return defaultSensitivePlaceholder
+		}
+		return string(runes[:n]) + defaultSensitivePlaceholder
+	}
+}
+
+// regexSanitizer is the built-in Sanitizer, based on the sensitive keys and values regexes.
+// Regexes are compiled once and are safe for concurrent use.
+type regexSanitizer struct {
+	// keys matches the names of headers, query parameters, JSON keys and cookies whose values are redacted
+	keys *regexp.Regexp
+	// values matches sensitive values, wherever they appear
+	values *regexp.Regexp
+	// cookies matches the names of cookies whose values are redacted
+	cookies *regexp.Regexp
+	// placeholder replaces sensitive data
+	placeholder string
+	// redactAllCookies redacts the value of every cookie, not only the ones with a sensitive name
+	redactAllCookies bool
+	// headerRules are the rules redacting the headers, by lowercased name, see Agent.HeaderRules
+	headerRules map[string]HeaderRule
+	// partialAuthorization keeps the scheme and the safe JWT header claims of Authorization headers
+	partialAuthorization bool
+	// basicCredentials redacts "Basic <base64>" credentials wherever they appear
+	basicCredentials bool
+	// luhnCardNumbers redacts the runs of 13 to 19 digits which pass the Luhn checksum
+	luhnCardNumbers bool
+	// ibans redacts the IBANs which pass the mod-97 checksum
+	ibans bool
+	// bics redacts the strings looking like SWIFT/BIC codes
+	bics bool
+	// secretStrings replaces the literal secrets with the placeholder, wherever they appear
+	secretStrings *strings.Replacer
+	// graphQLPaths are the patterns of the paths of GraphQL requests, see Agent.GraphQLPaths
+	graphQLPaths []string
+	// phoneNumbers match the phone numbers of the enabled formats
+	phoneNumbers []*regexp.Regexp
+	// profileKeys are the lowercased names of the keys of the enabled SensitiveKeyProfiles
+	profileKeys map[string]bool
+	// profileValues match the sensitive values of the enabled RedactionProfiles, wherever they appear
+	profileValues []*regexp.Regexp
+	// jsonPaths are the dotted paths ("data.user.ssn") of the JSON values which are redacted
+	jsonPaths map[string]bool
+}
+
 var (
-	sensitiveKeys   = regexp.MustCompile(defaultStripSensitiveKeys)
-	sensitiveValues = regexp.MustCompile(defaultStripSensitiveRegex)
-	// FIXME: remove globals
+	defaultSensitiveKeys    = regexp.MustCompile(defaultStripSensitiveKeys)
+	defaultSensitiveValues  = regexp.MustCompile(defaultStripSensitiveRegex)
+	defaultSensitiveCookies = regexp.MustCompile(defaultStripSensitiveCookies)
+	// defaultSensitiveBytes holds a byte required by each alternative of the default sensitive values regex
+	defaultSensitiveBytes = requiredBytes(defaultStripSensitiveRegex)
+
+	// NoSensitiveValues matches nothing. Used as Agent.SensitiveValues, it disables the redaction
+	// of sensitive values, while the values of sensitive keys are still redacted.
+	NoSensitiveValues = regexp.MustCompile(`[^\s\S]`)
+
+	basicCredentialsRegex = regexp.MustCompile(`\bBasic +([A-Za-z0-9+/]+={0,2})`)
+	cardNumberCandidate   = regexp.MustCompile(`\b\d(?:[ -]?\d){12,18}\b`)
+	ibanCandidate         = regexp.MustCompile(`\b[A-Z]{2}\d{2}(?: ?[A-Z0-9]){11,30}\b`)
+	bicCandidate          = regexp.MustCompile(`\b[A-Z]{4}[A-Z]{2}[A-Z0-9]{2}(?:[A-Z0-9]{3})?\b`)
+
+	// AWSSensitiveKeys are the headers and query parameters carrying AWS credentials and SigV4 signatures,
+	// including the ones of presigned URLs and of S3 server-side encryption with customer keys.
+	AWSSensitiveKeys = SensitiveKeyProfile{
+		"X-Amz-Security-Token",
+		"X-Amz-Credential",
+		"X-Amz-Signature",
+		"X-Amz-Date",
+		"X-Amz-Server-Side-Encryption-Customer-Key",
+		"X-Amz-Copy-Source-Server-Side-Encryption-Customer-Key",
+	}
+
+	// RedactionProfiles are the presets which can be enabled by name with Agent.Profiles.
+	// Entries can be added or replaced, before the agents using them are started.
+	RedactionProfiles = map[string]RedactionProfile{
+		// payment cards: numbers passing the Luhn checksum, CVV and expiry dates
+		"pci": {
+			Keys: SensitiveKeyProfile{
+				"card", "card_number", "cardnumber", "pan", "cvv", "cvv2", "cvc", "cvc2", "cid",
+				"security_code", "securitycode", "expiry", "exp_month", "exp_year", "expiration_date",
+			},
+			Values: []*regexp.Regexp{cardNumberCandidate},
+		},
+		// personal data: names, emails, phone numbers, addresses and birth dates
+		"gdpr": {
+			Keys: SensitiveKeyProfile{
+				"name", "first_name", "firstname", "last_name", "lastname", "full_name", "fullname",
+				"email", "phone", "phone_number", "mobile", "address", "street", "postcode", "zip",
+				"date_of_birth", "dob", "birthdate",
+			},
+			Values: []*regexp.Regexp{
+				regexp.MustCompile(`[a-zA-Z0-9._%+-]+@[a-zA-Z0-9-]+(?:\.[a-zA-Z0-9-]+)+`),
+				regexp.MustCompile(`\+\d{1,3}(?:[ .-]?\(?\d{1,4}\)?){2,5}\d`),
+			},
+		},
+		// AWS credentials, SigV4 signatures and access key IDs
+		"aws": {
+			Keys:   AWSSensitiveKeys,
+			Values: []*regexp.Regexp{regexp.MustCompile(`\b(?:AKIA|ASIA)[A-Z0-9]{16}\b`)},
+		},
+		// Google Cloud credentials: API keys, OAuth access tokens and signed URLs
+		"gcp": {
+			Keys: SensitiveKeyProfile{
+				"X-Goog-Api-Key", "X-Goog-Iam-Authorization-Token", "X-Goog-Signature", "X-Goog-Credential",
+				"private_key", "private_key_id",
+			},
+			Values: []*regexp.Regexp{
+				regexp.MustCompile(`\bAIza[0-9A-Za-z_-]{35}`),
+				regexp.MustCompile(`\bya29\.[0-9A-Za-z_-]+`),
+			},
+		},
+	}
+
+	// phoneNumberFormats are the phone number formats which can be enabled with Agent.PhoneNumberRegions.
+	// National formats require separators, so that numeric IDs are kept.
+	phoneNumberFormats = map[string]*regexp.Regexp{
+		// international format, i.e., "+33 6 12 34 56 78" or "+14155552671"
+		"E164": regexp.MustCompile(`\+[1-9](?:[ .-]?\(?\d\)?){6,14}\b`),
+		// i.e., "(415) 555-2671", "415-555-2671" or "415.555.2671"
+		"US": regexp.MustCompile(`(?:\(\d{3}\) ?|\b\d{3}[-.])\d{3}[-.]\d{4}\b`),
+		// i.e., "06 12 34 56 78" or "06.12.34.56.78"
+		"FR": regexp.MustCompile(`\b0[1-9](?:[ .-]\d{2}){4}\b`),
+		// i.e., "020 7946 0958" or "07700 900123"
+		"GB": regexp.MustCompile(`\b0(?:\d{2} \d{4} \d{4}|\d{4} \d{6}|\d{3} \d{3} \d{4})\b`),
+	}
+
+	defaultSanitizer = regexSanitizer{
+		keys:        defaultSensitiveKeys,
+		values:      defaultSensitiveValues,
+		cookies:     defaultSensitiveCookies,
+		placeholder: defaultSensitivePlaceholder,
+	}
 )
 
+// sensitiveKey returns true if the value of the key k must be redacted.
+func (s regexSanitizer) sensitiveKey(k string) bool {
+	return s.keys.MatchString(k) || s.profileKeys[strings.ToLower(k)]
+}
+
 // sanitize prevents most of the credentials from being sent to Bearer
-func (r *reportLog) sanitize() error {
+func (r *ReportLog) sanitize() error {
+	return defaultSanitizer.Sanitize(r)
+}
+
+// Sanitize implements the Sanitizer interface
+func (s regexSanitizer) Sanitize(r *ReportLog) error {
 	// sanitize headers
-	if r.RequestHeaders != nil {
-		for k, v := range r.RequestHeaders {
-			if sensitiveKeys.MatchString(k) {
-				r.RequestHeaders[k] = defaultSensitivePlaceholder
-			} else {
-				r.RequestHeaders[k] = sensitiveValues.ReplaceAllString(v, defaultSensitivePlaceholder)
+	s.sanitizeHeaders(r.RequestHeaders)
+	s.sanitizeHeaders(r.OutboundRequestHeaders)
+	s.sanitizeHeaders(r.ResponseHeaders)
+	s.sanitizeHeaders(r.ResponseTrailers)
+
+	// sanitize URL & query
+	if r.URL != "" {
+		r.Path = s.replaceValues(r.Path)
+		r.URL = s.sanitizeURL(r.URL)
+	}
+	s.sanitizeParams(r.QueryParams)
+	s.sanitizeParams(r.RequestForm)
+
+	// sanitize tags, only by key as they are set by the application
+	for k := range r.Tags {
+		if s.sensitiveKey(k) {
+			r.Tags[k] = s.placeholder
+		}
+	}
+
+	// sanitize bodies
+	var (
+		body string
+		err  error
+	)
+	if strings.HasPrefix(r.RequestContentType(), "application/json") && matchPaths(s.graphQLPaths, r.Path) {
+		body, err = s.sanitizeJSONDocument(r.RequestBody, true)
+	} else {
+		body, err = s.sanitizeBody(r.RequestBody, r.RequestContentType())
+	}
+	if err != nil {
+		return err
+	}
+	r.RequestBody = body
+	body, err = s.sanitizeBody(r.ResponseBody, r.ResponseContentType())
+	if err != nil {
+		return err
+	}
+	r.ResponseBody = body
+
+	return nil
+}
+
+// replaceValues replaces the sensitive values of input with the placeholder.
+func (s regexSanitizer) replaceValues(input string) string {
+	if s.secretStrings != nil {
+		input = s.secretStrings.Replace(input)
+	}
+	if s.basicCredentials {
+		input = s.replaceBasicCredentials(input)
+	}
+	if s.luhnCardNumbers {
+		input = s.replaceCardNumbers(input)
+	}
+	if s.ibans {
+		input = s.replaceIBANs(input)
+	}
+	if s.bics {
+		input = s.replaceBICs(input)
+	}
+	for _, phoneNumbers := range s.phoneNumbers {
+		input = phoneNumbers.ReplaceAllString(input, s.placeholder)
+	}
+	for _, values := range s.profileValues {
+		input = values.ReplaceAllString(input, s.placeholder)
+	}
+	if s.values == NoSensitiveValues || s.values == defaultSensitiveValues && !mayContainSensitiveValues(input) {
+		return input
+	}
+	return s.values.ReplaceAllString(input, s.placeholder)
+}
+
+// replaceBasicCredentials replaces the credentials of "Basic <base64>" tokens with the placeholder.
+// To avoid mangling legitimate base64 data, a token is only redacted if it decodes to "user:password".
+func (s regexSanitizer) replaceBasicCredentials(input string) string {
+	if !strings.Contains(input, "Basic ") {
+		return input
+	}
+	return basicCredentialsRegex.ReplaceAllStringFunc(input, func(match string) string {
+		credentials := basicCredentialsRegex.FindStringSubmatch(match)[1]
+		decoded, err := base64.StdEncoding.DecodeString(credentials)
+		if err != nil || !strings.Contains(string(decoded), ":") {
+			return match
+		}
+		return "Basic " + s.placeholder
+	})
+}
+
+// replaceCardNumbers replaces the card numbers of input with the placeholder.
+// Only the digit runs passing the Luhn checksum are replaced, so that most numeric IDs are kept.
+func (s regexSanitizer) replaceCardNumbers(input string) string {
+	return cardNumberCandidate.ReplaceAllStringFunc(input, func(match string) string {
+		if !luhnValid(match) {
+			return match
+		}
+		return s.placeholder
+	})
+}
+
+// luhnValid returns true if the digits of input (ignoring spaces and dashes) pass the Luhn checksum.
+func luhnValid(input string) bool {
+	sum, count := 0, 0
+	for i := len(input) - 1; i >= 0; i-- {
+		c := input[i]
+		if c == ' ' || c == '-' {
+			continue
+		}
+		digit := int(c - '0')
+		if count%2 == 1 {
+			digit *= 2
+			if digit > 9 {
+				digit -= 9
+			}
+		}
+		sum += digit
+		count++
+	}
+	return count > 0 && sum%10 == 0
+}
+
+// replaceIBANs replaces the IBANs of input with the placeholder.
+// Only the candidates passing the mod-97 checksum are replaced.
+func (s regexSanitizer) replaceIBANs(input string) string {
+	return ibanCandidate.ReplaceAllStringFunc(input, func(match string) string {
+		if !ibanValid(match) {
+			return match
+		}
+		return s.placeholder
+	})
+}
+
+// replaceBICs replaces the SWIFT/BIC codes of input with the placeholder.
+// As the placeholder may itself look like a BIC ("FILTERED"), the existing placeholders are kept.
+func (s regexSanitizer) replaceBICs(input string) string {
+	parts := strings.Split(input, s.placeholder)
+	for idx, part := range parts {
+		parts[idx] = bicCandidate.ReplaceAllLiteralString(part, s.placeholder)
+	}
+	return strings.Join(parts, s.placeholder)
+}
+
+// ibanValid returns true if input (ignoring spaces) passes the IBAN mod-97 checksum:
+// the first four characters are moved to the end, letters are converted to numbers (A=10, ..., Z=35),
+// and the resulting number modulo 97 must be 1.
+func ibanValid(input string) bool {
+	iban := strings.Replace(input, " ", "", -1)
+	if len(iban) < 15 || len(iban) > 34 {
+		return false
+	}
+	remainder := 0
+	for _, c := range iban[4:] + iban[:4] {
+		switch {
+		case c >= '0' && c <= '9':
+			remainder = (remainder*10 + int(c-'0')) % 97
+		case c >= 'A' && c <= 'Z':
+			remainder = (remainder*100 + int(c-'A') + 10) % 97
+		default:
+			return false
+		}
+	}
+	return remainder == 1
+}
+
+// mayContainSensitiveValues is a cheap pre-check for the default sensitive values regex:
+// none of its alternatives can match without one of defaultSensitiveBytes, i.e., the '@' of the email one,
+// and the digits of the card number one. Many values contain neither, which skips running the regex.
+// As the bytes are derived from the regex, changing it cannot make the pre-check skip values it matches.
+func mayContainSensitiveValues(input string) bool {
+	return defaultSensitiveBytes == "" || strings.ContainsAny(input, defaultSensitiveBytes)
+}
+
+// requiredBytes returns, for each alternative of the regex expr, the ASCII bytes one of which it cannot match without.
+// It returns "" if an alternative has no such bytes, i.e., ".+", as no pre-check is then possible.
+func requiredBytes(expr string) string {
+	re, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		return ""
+	}
+	alternatives := []*syntax.Regexp{re}
+	if re.Op == syntax.OpAlternate {
+		alternatives = re.Sub
+	}
+	var required []byte
+	for _, alternative := range alternatives {
+		bytes, ok := requiredByteSet(alternative)
+		if !ok {
+			return ""
+		}
+		for _, b := range bytes {
+			if strings.IndexByte(string(required), b) < 0 {
+				required = append(required, b)
 			}
 		}
 	}
-	if r.ResponseHeaders != nil {
-		for k, v := range r.ResponseHeaders {
-			if sensitiveKeys.MatchString(k) {
-				r.ResponseHeaders[k] = defaultSensitivePlaceholder
-			} else {
-				r.ResponseHeaders[k] = sensitiveValues.ReplaceAllString(v, defaultSensitivePlaceholder)
+	return string(required)
+}
+
+// maxRequiredClass is the size of the largest character class used by requiredByteSet, i.e., "\d".
+// Larger classes, such as letters, are in most values anyway, and would not skip the regex.
+const maxRequiredClass = 10
+
+// requiredByteSet returns ASCII bytes one of which re cannot match without, if any.
+func requiredByteSet(re *syntax.Regexp) ([]byte, bool) {
+	switch re.Op {
+	case syntax.OpLiteral:
+		if re.Flags&syntax.FoldCase == 0 && re.Rune[0] < 0x80 {
+			return []byte{byte(re.Rune[0])}, true
+		}
+	case syntax.OpCharClass:
+		var bytes []byte
+		for i := 0; i+1 < len(re.Rune); i += 2 {
+			if re.Rune[i+1] >= 0x80 || int(re.Rune[i+1]-re.Rune[i])+1 > maxRequiredClass-len(bytes) {
+				return nil, false
+			}
+			for r := re.Rune[i]; r <= re.Rune[i+1]; r++ {
+				bytes = append(bytes, byte(r))
+			}
+		}
+		return bytes, len(bytes) > 0
+	case syntax.OpCapture, syntax.OpPlus:
+		return requiredByteSet(re.Sub[0])
+	case syntax.OpRepeat:
+		if re.Min > 0 {
+			return requiredByteSet(re.Sub[0])
+		}
+	case syntax.OpConcat:
+		for _, sub := range re.Sub {
+			if bytes, ok := requiredByteSet(sub); ok {
+				return bytes, true
 			}
 		}
 	}
+	return nil, false
+}
 
-	// sanitize URL & query
-	if r.URL != "" {
-		r.URL = sensitiveValues.ReplaceAllString(r.URL, defaultSensitivePlaceholder)
-		r.Path = sensitiveValues.ReplaceAllString(r.Path, defaultSensitivePlaceholder)
-		u, err := url.Parse(r.URL)
-		if err != nil {
-			return err
-		}
-		changed := false
-		queries := u.Query()
-		for k, values := range queries {
-			if sensitiveKeys.MatchString(k) {
-				for idx := range values {
-					values[idx] = defaultSensitivePlaceholder
-				}
+// sanitizeURL redacts the password of the userinfo and the sensitive parts of the path,
+// query and fragment of a URL, keeping the scheme and the host intact so the result is still a valid URL.
+func (s regexSanitizer) sanitizeURL(input string) string {
+	u, err := url.Parse(input)
+	if err != nil {
+		// not a valid URL, there is no structure to preserve
+		return s.replaceValues(input)
+	}
+	changed := false
+	if u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(s.replaceValues(u.User.Username()), s.placeholder)
+			changed = true
+		}
+	}
+	if path := s.replaceValues(u.Path); path != u.Path {
+		u.Path = path
+		u.RawPath = ""
+		changed = true
+	}
+	queries := u.Query()
+	if s.sanitizeQuery(queries) {
+		u.RawQuery = queries.Encode()
+		changed = true
+	}
+	if fragment := s.replaceValues(u.Fragment); fragment != u.Fragment {
+		u.Fragment = fragment
+		u.RawFragment = ""
+		changed = true
+	}
+	if !changed {
+		return input
+	}
+	return u.String()
+}
+
+// sanitizeParams redacts the values of sensitive keys, and the sensitive values of other keys.
+func (s regexSanitizer) sanitizeParams(params map[string]string) {
+	for k, v := range params {
+		if s.sensitiveKey(k) {
+			params[k] = s.placeholder
+		} else {
+			params[k] = s.replaceValues(v)
+		}
+	}
+}
+
+// sanitizeQuery redacts the values of sensitive keys, and the sensitive values of other keys.
+// It returns true if at least one value was changed.
+func (s regexSanitizer) sanitizeQuery(queries url.Values) bool {
+	changed := false
+	for k, values := range queries {
+		for idx, value := range values {
+			sanitized := s.placeholder
+			if !s.sensitiveKey(k) {
+				sanitized = s.replaceValues(value)
+			}
+			if sanitized != value {
+				values[idx] = sanitized
 				changed = true
 			}
 		}
-		if changed {
-			u.RawQuery = queries.Encode()
-			r.URL = u.String()
+	}
+	return changed
+}
+
+func (s regexSanitizer) sanitizeHeaders(headers map[string]string) {
+	for k, v := range headers {
+		if rule, ok := s.headerRules[strings.ToLower(k)]; ok {
+			headers[k] = rule(v)
+			continue
+		}
+		switch {
+		case s.partialAuthorization && strings.EqualFold(k, "Authorization"):
+			headers[k] = s.redactAuthorization(v)
+		case s.sensitiveKey(k):
+			headers[k] = s.placeholder
+		case strings.EqualFold(k, "Cookie"):
+			headers[k] = s.sanitizeCookies(v, false)
+		case strings.EqualFold(k, "Set-Cookie"):
+			headers[k] = s.sanitizeCookies(v, true)
+		default:
+			headers[k] = s.replaceValues(v)
 		}
 	}
+}
 
-	// sanitize bodies
-	if r.RequestBody != "" && strings.HasPrefix(r.RequestContentType(), "application/json") {
-		body, err := sanitizeJSON(r.RequestBody)
-		if err != nil {
-			return err
+// redactAuthorization redacts the credentials of an Authorization header, keeping its scheme,
+// i.e., "Basic [FILTERED]". For JWT bearer tokens, the non-sensitive header claims are kept:
+// "Bearer [FILTERED] (alg=RS256, kid=key1, typ=JWT)".
+func (s regexSanitizer) redactAuthorization(input string) string {
+	parts := strings.SplitN(strings.TrimSpace(input), " ", 2)
+	if len(parts) != 2 {
+		return s.placeholder
+	}
+	scheme, credentials := parts[0], strings.TrimSpace(parts[1])
+	ret := scheme + " " + s.placeholder
+	if !strings.EqualFold(scheme, "Bearer") {
+		return ret
+	}
+	segments := strings.Split(credentials, ".")
+	if len(segments) != 3 {
+		return ret
+	}
+	header, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(segments[0], "="))
+	if err != nil {
+		return ret
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(header, &claims); err != nil {
+		return ret
+	}
+	safe := []string{}
+	for _, key := range []string{"alg", "kid", "typ"} {
+		if value, ok := claims[key].(string); ok {
+			safe = append(safe, key+"="+s.replaceValues(value))
 		}
-		r.RequestBody = body
 	}
-	if r.ResponseBody != "" && strings.HasPrefix(r.ResponseContentType(), "application/json") {
-		body, err := sanitizeJSON(r.ResponseBody)
+	if len(safe) == 0 {
+		return ret
+	}
+	return ret + " (" + strings.Join(safe, ", ") + ")"
+}
+
+// sanitizeCookies redacts the values of a Cookie or Set-Cookie header.
+// For Set-Cookie, only the first pair is a cookie, the following ones are attributes.
+func (s regexSanitizer) sanitizeCookies(input string, setCookie bool) string {
+	parts := strings.Split(input, ";")
+	for idx, part := range parts {
+		if setCookie && idx > 0 {
+			parts[idx] = s.replaceValues(part)
+			continue
+		}
+		eq := strings.Index(part, "=")
+		if eq < 0 {
+			continue
+		}
+		name := strings.TrimSpace(part[:eq])
+		if s.redactAllCookies || s.sensitiveKey(name) || s.cookies.MatchString(name) {
+			parts[idx] = part[:eq+1] + s.placeholder
+		} else {
+			parts[idx] = part[:eq+1] + s.replaceValues(part[eq+1:])
+		}
+	}
+	return strings.Join(parts, ";")
+}
+
+// sanitizeBody redacts JSON, NDJSON and form bodies key by key, and other bodies as plain text.
+func (s regexSanitizer) sanitizeBody(body, contentType string) (string, error) {
+	if body == "" {
+		return body, nil
+	}
+	if strings.HasPrefix(contentType, "application/json") {
+		return s.sanitizeJSON(body)
+	}
+	if strings.HasPrefix(contentType, "application/x-ndjson") {
+		return s.sanitizeNDJSON(body)
+	}
+	if strings.HasPrefix(contentType, "application/x-www-form-urlencoded") {
+		return s.sanitizeForm(body), nil
+	}
+	return s.replaceValues(body), nil
+}
+
+// sanitizeForm redacts a form-encoded body like a query string.
+func (s regexSanitizer) sanitizeForm(input string) string {
+	values, err := url.ParseQuery(input)
+	if err != nil {
+		return s.replaceValues(input)
+	}
+	if !s.sanitizeQuery(values) {
+		return input
+	}
+	return values.Encode()
+}
+
+// sanitizeNDJSON redacts a newline-delimited JSON body, one JSON object per line.
+func (s regexSanitizer) sanitizeNDJSON(input string) (string, error) {
+	lines := strings.Split(input, "\n")
+	for idx, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		sanitized, err := s.sanitizeJSON(line)
 		if err != nil {
-			return err
+			return input, err
 		}
-		r.ResponseBody = body
+		lines[idx] = sanitized
 	}
+	return strings.Join(lines, "\n"), nil
+}
 
-	return nil
+func (s regexSanitizer) sanitizeJSON(input string) (string, error) {
+	return s.sanitizeJSONDocument(input, false)
 }
 
-func sanitizeJSON(input string) (string, error) {
+// sanitizeJSONDocument redacts a JSON object, which is a GraphQL request if it has the shape of one,
+// or if graphQLPath is true and it has a query.
+func (s regexSanitizer) sanitizeJSONDocument(input string, graphQLPath bool) (string, error) {
 	var obj map[string]interface{}
 	if err := json.Unmarshal([]byte(input), &obj); err != nil {
 		// json cannot unmarshal to the map[string]interface{} destination
@@ -92,17 +632,10 @@ func sanitizeJSON(input string) (string, error) {
 		return input, nil
 	}
 
-	for k, v := range obj {
-		if sensitiveKeys.MatchString(k) {
-			obj[k] = defaultSensitivePlaceholder
-		} else {
-			switch t := v.(type) {
-			case string:
-				obj[k] = sensitiveValues.ReplaceAllString(t, defaultSensitivePlaceholder)
-				// FIXME: support nested maps
-			}
-		}
+	if isGraphQLRequest(obj, graphQLPath) {
+		s.sanitizeGraphQL(obj)
 	}
+	s.sanitizeJSONObject(obj, "")
 
 	out, err := json.Marshal(obj)
 	if err != nil {
@@ -110,3 +643,35 @@ func sanitizeJSON(input string) (string, error) {
 	}
 	return string(out), nil
 }
+
+// sanitizeJSONObject redacts the values of sensitive keys and paths of a JSON object, recursively.
+// path is the dotted path of obj from the root of the document, i.e., "data.user".
+func (s regexSanitizer) sanitizeJSONObject(obj map[string]interface{}, path string) {
+	for k, v := range obj {
+		childPath := k
+		if path != "" {
+			childPath = path + "." + k
+		}
+		if s.sensitiveKey(k) || s.jsonPaths[childPath] {
+			obj[k] = s.placeholder
+		} else {
+			obj[k] = s.sanitizeJSONValue(v, childPath)
+		}
+	}
+}
+
+// sanitizeJSONValue returns the sanitized version of a JSON value.
+// The elements of arrays have the path of the array.
+func (s regexSanitizer) sanitizeJSONValue(value interface{}, path string) interface{} {
+	switch t := value.(type) {
+	case string:
+		return s.replaceValues(t)
+	case map[string]interface{}:
+		s.sanitizeJSONObject(t, path)
+	case []interface{}:
+		for idx, item := range t {
+			t[idx] = s.sanitizeJSONValue(item, path)
+		}
+	}
+	return value
+}
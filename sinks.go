@@ -0,0 +1,50 @@
+package bearer
+
+import (
+	"context"
+	"strings"
+	"sync"
+)
+
+// RecordSink receives the sanitized records delivered by the agent,
+// i.e., to ship them to a local file or a message queue in addition to Bearer.
+type RecordSink interface {
+	Send(ctx context.Context, records []ReportLog) error
+}
+
+// MemorySink is a RecordSink keeping the records in memory, mostly useful for testing.
+type MemorySink struct {
+	mutex   sync.Mutex
+	records []ReportLog
+}
+
+// Send implements the RecordSink interface
+func (s *MemorySink) Send(ctx context.Context, records []ReportLog) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.records = append(s.records, records...)
+	return nil
+}
+
+// Records returns a copy of the records received so far.
+func (s *MemorySink) Records() []ReportLog {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]ReportLog{}, s.records...)
+}
+
+// sinkErrors aggregates the errors of the sinks which failed to receive a batch.
+type sinkErrors []error
+
+func (e sinkErrors) Error() string {
+	messages := make([]string, len(e))
+	for idx, err := range e {
+		messages[idx] = err.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+// Unwrap returns the first error, so errors.Is and errors.As work for it.
+func (e sinkErrors) Unwrap() error {
+	return e[0]
+}
@@ -0,0 +1,217 @@
+package bearer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// spool persists the records being delivered to JSON lines files of a directory,
+// so that the records of a process which died before delivering them are replayed by the next one.
+//
+// Each spool appends to its own file, one line per record, then one line (with only the ID of the record)
+// once it is delivered. The file is removed when all its records are delivered, and compacted when
+// most of its lines are about delivered records, i.e., when records which failed to be delivered are kept.
+type spool struct {
+	dir string
+
+	mutex   sync.Mutex
+	name    string
+	file    *os.File
+	nextID  uint64
+	pending int
+	lines   int
+}
+
+// spoolCompactLines is the number of lines from which a spool file is compacted,
+// if at least half of them are about delivered records.
+const spoolCompactLines = 64
+
+// spoolEntry is a line of a spool file: a record to deliver, or the ID of a delivered record.
+type spoolEntry struct {
+	ID     uint64     `json:"id"`
+	Record *ReportLog `json:"record,omitempty"`
+}
+
+// openSpool opens a spool in dir, and returns the records left undelivered by previous spools,
+// after moving them to the new spool.
+func openSpool(dir string) (*spool, []spooledRecord, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, nil, fmt.Errorf("create spool directory: %w", err)
+	}
+	leftovers, err := filepath.Glob(filepath.Join(dir, "*.jsonl"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("list spool files: %w", err)
+	}
+	s := &spool{dir: dir}
+	var replayed []spooledRecord
+	for _, name := range leftovers {
+		records, err := readSpoolFile(name)
+		if err != nil {
+			return s, replayed, err
+		}
+		// the records are moved before removing the file, so they are not lost if the process dies meanwhile
+		for _, spooled := range records {
+			id, err := s.append(spooled.record)
+			if err != nil {
+				return s, replayed, err
+			}
+			replayed = append(replayed, spooledRecord{id: id, record: spooled.record})
+		}
+		if err := os.Remove(name); err != nil {
+			return s, replayed, fmt.Errorf("remove spool file: %w", err)
+		}
+	}
+	return s, replayed, nil
+}
+
+// spooledRecord is a record of a spool, with its ID.
+type spooledRecord struct {
+	id     uint64
+	record ReportLog
+}
+
+// append writes record to the spool, and returns its ID.
+func (s *spool) append(record ReportLog) (uint64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.file == nil {
+		name := fmt.Sprintf("bearer-%d-%s.jsonl", os.Getpid(), strconv.FormatInt(time.Now().UnixNano(), 36))
+		file, err := os.OpenFile(filepath.Join(s.dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_APPEND, 0600)
+		if err != nil {
+			return 0, fmt.Errorf("create spool file: %w", err)
+		}
+		s.name, s.file = file.Name(), file
+	}
+	s.nextID++
+	if err := s.write(spoolEntry{ID: s.nextID, Record: &record}); err != nil {
+		return 0, err
+	}
+	s.pending++
+	return s.nextID, nil
+}
+
+// remove marks the record id as delivered.
+func (s *spool) remove(id uint64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	s.pending--
+	if s.pending <= 0 {
+		// every record is delivered, the next ones go to a new file
+		s.file.Close()
+		s.file = nil
+		s.pending, s.lines = 0, 0
+		if err := os.Remove(s.name); err != nil {
+			return fmt.Errorf("remove spool file: %w", err)
+		}
+		return nil
+	}
+	if err := s.write(spoolEntry{ID: id}); err != nil {
+		return err
+	}
+	if s.lines >= spoolCompactLines && s.lines >= 2*s.pending {
+		return s.compact()
+	}
+	return nil
+}
+
+// compact rewrites the spool file with only its undelivered records.
+// The file is replaced atomically, so that a process dying meanwhile leaves either the old or the new one.
+// Must be called with the mutex held.
+func (s *spool) compact() error {
+	records, err := readSpoolFile(s.name)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	for _, spooled := range records {
+		record := spooled.record
+		line, err := json.Marshal(spoolEntry{ID: spooled.id, Record: &record})
+		if err != nil {
+			return fmt.Errorf("marshal spool entry: %w", err)
+		}
+		buf.Write(append(line, '\n'))
+	}
+	// the temporary file does not match the pattern of spool files, so it is never replayed
+	tmp := s.name + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("write spool file: %w", err)
+	}
+	if err := os.Rename(tmp, s.name); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("replace spool file: %w", err)
+	}
+	file, err := os.OpenFile(s.name, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("open spool file: %w", err)
+	}
+	s.file.Close()
+	s.file, s.lines = file, len(records)
+	return nil
+}
+
+// write appends entry to the spool file, in a single write so that concurrent
+// readers see either nothing or a partial last line, which is ignored.
+// Must be called with the mutex held.
+func (s *spool) write(entry spoolEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("marshal spool entry: %w", err)
+	}
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("write spool file: %w", err)
+	}
+	s.lines++
+	return nil
+}
+
+// readSpoolFile returns the undelivered records of a spool file, in order.
+// Lines which can not be decoded, i.e., partially written when the process died, are ignored.
+func readSpoolFile(name string) ([]spooledRecord, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("open spool file: %w", err)
+	}
+	defer file.Close()
+
+	var ids []uint64
+	records := map[uint64]*ReportLog{}
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		var entry spoolEntry
+		if len(bytes.TrimSpace(line)) > 0 && json.Unmarshal(line, &entry) == nil {
+			if entry.Record != nil {
+				ids = append(ids, entry.ID)
+				records[entry.ID] = entry.Record
+			} else {
+				delete(records, entry.ID)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read spool file: %w", err)
+		}
+	}
+	var ret []spooledRecord
+	for _, id := range ids {
+		if record, ok := records[id]; ok {
+			ret = append(ret, spooledRecord{id: id, record: *record})
+		}
+	}
+	return ret, nil
+}
@@ -0,0 +1,100 @@
+package bearer
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// requestTrace collects low-level information about a request using httptrace.
+type requestTrace struct {
+	// addrs, dns and timings select the information applied to records
+	addrs   bool
+	dns     bool
+	timings bool
+	now     func() time.Time
+
+	mutex       sync.Mutex
+	remoteAddr  string
+	localAddr   string
+	resolvedIPs []string
+	dnsError    string
+	firstByte   time.Time
+}
+
+// withTrace returns a shallow copy of req with a client trace collecting information in t.
+func (t *requestTrace) withTrace(req *http.Request) *http.Request {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.mutex.Lock()
+			defer t.mutex.Unlock()
+			if info.Conn == nil {
+				return
+			}
+			t.remoteAddr = info.Conn.RemoteAddr().String()
+			t.localAddr = info.Conn.LocalAddr().String()
+		},
+		// not called if the round trip failed before the response
+		GotFirstResponseByte: func() {
+			t.mutex.Lock()
+			defer t.mutex.Unlock()
+			t.firstByte = t.now()
+		},
+		// not called when a connection is reused, or when the host is an IP address
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			t.mutex.Lock()
+			defer t.mutex.Unlock()
+			if info.Err != nil {
+				t.dnsError = info.Err.Error()
+				return
+			}
+			t.resolvedIPs = make([]string, 0, len(info.Addrs))
+			for _, addr := range info.Addrs {
+				t.resolvedIPs = append(t.resolvedIPs, addr.IP.String())
+			}
+		},
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
+
+// apply copies the collected information to the record.
+func (t *requestTrace) apply(record *ReportLog) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.addrs {
+		record.RemoteAddr = t.remoteAddr
+		record.LocalAddr = t.localAddr
+	}
+	if t.dns {
+		record.ResolvedIPs = t.resolvedIPs
+		record.DNSError = t.dnsError
+	}
+	if t.timings && !t.firstByte.IsZero() {
+		record.TimeToFirstByte = int(t.firstByte.UnixNano()/1000000) - record.StartedAt
+	}
+}
+
+// timedBody records when a response body has been fully read or closed.
+type timedBody struct {
+	io.ReadCloser
+	now   func() time.Time
+	ended time.Time
+}
+
+func (b *timedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF && b.ended.IsZero() {
+		b.ended = b.now()
+	}
+	return n, err
+}
+
+func (b *timedBody) Close() error {
+	err := b.ReadCloser.Close()
+	if b.ended.IsZero() {
+		b.ended = b.now()
+	}
+	return err
+}
@@ -8,26 +8,105 @@ type Config struct {
 	// FIXME: add missing fieldss
 }
 
-// reportLog is the log object sent to Bearer's API.
-type reportLog struct {
-	Protocol        string            `json:"protocol"`
-	Path            string            `json:"path"`
-	Hostname        string            `json:"hostname"`
-	Method          string            `json:"method"`
-	StartedAt       int               `json:"startedAt"`
-	EndedAt         int               `json:"endedAt"`
-	Type            string            `json:"type"`
-	StatusCode      int               `json:"statusCode"`
-	URL             string            `json:"url"`
-	RequestHeaders  map[string]string `json:"requestHeaders"`
-	RequestBody     string            `json:"requestBody"`
-	ResponseHeaders map[string]string `json:"responseHeaders"`
-	ResponseBody    string            `json:"responseBody"`
+// Stats is a snapshot of the agent's internal counters.
+type Stats struct {
+	// RecordsSent is the number of records successfully delivered to Bearer.
+	RecordsSent int `json:"recordsSent"`
+	// RecordsDropped is the number of records that could not be delivered.
+	RecordsDropped int `json:"recordsDropped"`
+	// BufferOverflows is the number of records dropped because the buffer was full (included in RecordsDropped).
+	BufferOverflows int `json:"bufferOverflows"`
+	// DeliveryErrors is the number of failed deliveries.
+	DeliveryErrors int `json:"deliveryErrors"`
+	// ConfigUpdates is the number of times the config was fetched.
+	ConfigUpdates int `json:"configUpdates"`
+	// PendingRecords is the number of records waiting to be delivered, buffered or being delivered.
+	PendingRecords int `json:"pendingRecords"`
+	// TruncatedBodies is the number of bodies truncated to MaxBodySize.
+	TruncatedBodies int `json:"truncatedBodies"`
+	// OversizedRecords is the number of records larger than MaxBatchBytes, truncated or dropped.
+	OversizedRecords int `json:"oversizedRecords"`
+	// CircuitState is the state of the circuit breaker of the deliveries to Bearer,
+	// or empty if CircuitBreakerThreshold is not set.
+	CircuitState CircuitState `json:"circuitState,omitempty"`
+}
+
+// RecordType is the type of a ReportLog.
+type RecordType string
+
+const (
+	// RequestEnd is the type of records of completed requests.
+	RequestEnd RecordType = "REQUEST_END"
+	// RequestError is the type of records of requests that failed before completion.
+	RequestError RecordType = "REQUEST_ERROR"
+	// RequestCancelled is the type of records of requests whose context was cancelled or timed out.
+	RequestCancelled RecordType = "REQUEST_CANCELLED"
+)
+
+// Valid returns true if t is a known RecordType.
+func (t RecordType) Valid() bool {
+	switch t {
+	case RequestEnd, RequestError, RequestCancelled:
+		return true
+	default:
+		return false
+	}
+}
+
+// ReportLog is the log object sent to Bearer's API.
+type ReportLog struct {
+	Protocol                 string            `json:"protocol"`
+	ProtoVersion             string            `json:"protoVersion,omitempty"`
+	Path                     string            `json:"path"`
+	Hostname                 string            `json:"hostname"`
+	Method                   string            `json:"method"`
+	StartedAt                int               `json:"startedAt"`
+	EndedAt                  int               `json:"endedAt"`
+	TimeToFirstByte          int               `json:"timeToFirstByte,omitempty"`
+	BodyReadTime             int               `json:"bodyReadTime,omitempty"`
+	LatencyBucket            string            `json:"latencyBucket,omitempty"`
+	Type                     RecordType        `json:"type"`
+	StatusCode               int               `json:"statusCode"`
+	URL                      string            `json:"url"`
+	QueryParams              map[string]string `json:"queryParams,omitempty"`
+	RequestHeaders           map[string]string `json:"requestHeaders"`
+	OutboundRequestHeaders   map[string]string `json:"outboundRequestHeaders,omitempty"`
+	RequestForm              map[string]string `json:"requestForm,omitempty"`
+	RequestBody              string            `json:"requestBody"`
+	ResponseHeaders          map[string]string `json:"responseHeaders"`
+	ResponseTrailers         map[string]string `json:"responseTrailers,omitempty"`
+	ResponseBody             string            `json:"responseBody"`
+	BodiesHashed             bool              `json:"bodiesHashed,omitempty"`
+	ResponseBodySkipped      bool              `json:"responseBodySkipped,omitempty"`
+	RequestBodyEncoding      string            `json:"requestBodyEncoding,omitempty"`
+	ResponseBodyEncoding     string            `json:"responseBodyEncoding,omitempty"`
+	OriginalRequestBodySize  int               `json:"originalRequestBodySize,omitempty"`
+	OriginalResponseBodySize int               `json:"originalResponseBodySize,omitempty"`
+	TruncatedRequestHeaders  int               `json:"truncatedRequestHeaders,omitempty"`
+	TruncatedResponseHeaders int               `json:"truncatedResponseHeaders,omitempty"`
+	CorrelationID            string            `json:"correlationId,omitempty"`
+	Attempt                  int               `json:"attempt,omitempty"`
+	RequestID                string            `json:"requestId,omitempty"`
+	CallSite                 string            `json:"callSite,omitempty"`
+	RedirectID               string            `json:"redirectId,omitempty"`
+	RedirectHop              int               `json:"redirectHop,omitempty"`
+	GraphQLOperation         string            `json:"graphqlOperation,omitempty"`
+	GRPCMethod               string            `json:"grpcMethod,omitempty"`
+	Count                    int               `json:"count,omitempty"`
+	TLSVersion               string            `json:"tlsVersion,omitempty"`
+	CipherSuite              string            `json:"cipherSuite,omitempty"`
+	RemoteAddr               string            `json:"remoteAddr,omitempty"`
+	LocalAddr                string            `json:"localAddr,omitempty"`
+	ResolvedIPs              []string          `json:"resolvedIps,omitempty"`
+	DNSError                 string            `json:"dnsError,omitempty"`
+	Tags                     map[string]string `json:"tags,omitempty"`
+	BytesSent                int               `json:"bytesSent"`
+	BytesReceived            int               `json:"bytesReceived"`
 	// FIXME: Instrumentation
 }
 
 // RequestContentType returns the value of the requesting "Content-Type" HTTP header.
-func (r reportLog) RequestContentType() string {
+func (r ReportLog) RequestContentType() string {
 	if r.RequestHeaders != nil {
 		for k, v := range r.RequestHeaders {
 			if strings.ToLower(k) == "content-type" {
@@ -39,7 +118,7 @@ func (r reportLog) RequestContentType() string {
 }
 
 // ResponseContentType returns the value of the replying "Content-Type" HTTP header.
-func (r reportLog) ResponseContentType() string {
+func (r ReportLog) ResponseContentType() string {
 	if r.ResponseHeaders != nil {
 		for k, v := range r.ResponseHeaders {
 			if strings.ToLower(k) == "content-type" {
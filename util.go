@@ -1,16 +1,320 @@
 package bearer
 
-import "net/http"
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
 
-func goHeadersToBearerHeaders(input http.Header) map[string]string {
+// goHeadersToBearerHeaders converts HTTP headers to Bearer headers.
+// If allowlist is not empty, only the headers it contains (case-insensitive) are kept.
+func goHeadersToBearerHeaders(input http.Header, allowlist []string) map[string]string {
 	if input == nil {
 		return nil
 	}
 	ret := map[string]string{}
 	for key, values := range input {
+		if len(allowlist) > 0 && !containsFold(allowlist, key) {
+			continue
+		}
 		// bearer headers only support one value per key
 		// so we take the first one and ignore the other ones
 		ret[key] = values[0]
 	}
 	return ret
 }
+
+// goTrailersToBearerHeaders converts HTTP trailers to Bearer headers.
+// Trailers declared but not received yet have no value, and are skipped.
+func goTrailersToBearerHeaders(input http.Header) map[string]string {
+	ret := map[string]string{}
+	for key, values := range input {
+		if len(values) > 0 {
+			ret[key] = values[0]
+		}
+	}
+	if len(ret) == 0 {
+		return nil
+	}
+	return ret
+}
+
+// goQueryToBearerQueryParams converts URL query values to Bearer query params.
+func goQueryToBearerQueryParams(input url.Values) map[string]string {
+	if len(input) == 0 {
+		return nil
+	}
+	ret := map[string]string{}
+	for key, values := range input {
+		// as for headers, we only keep the first value of repeated params
+		ret[key] = values[0]
+	}
+	return ret
+}
+
+// dropHeaders removes the given headers (case-insensitive) from headers.
+func dropHeaders(headers map[string]string, names []string) {
+	if len(names) == 0 {
+		return
+	}
+	for key := range headers {
+		if containsFold(names, key) {
+			delete(headers, key)
+		}
+	}
+}
+
+// firstHeader returns the value of the first of names present in headers, or an empty string.
+func firstHeader(headers http.Header, names []string) string {
+	for _, name := range names {
+		if value := headers.Get(name); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// truncateHeaders keeps at most max headers (sorted by name, so the result is deterministic),
+// and returns the number of removed headers. A max of 0 means no limit.
+func truncateHeaders(headers map[string]string, max int) int {
+	if max <= 0 || len(headers) <= max {
+		return 0
+	}
+	keys := make([]string, 0, len(headers))
+	for key := range headers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys[max:] {
+		delete(headers, key)
+	}
+	return len(keys) - max
+}
+
+func containsFold(list []string, value string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeBody returns a decompressed copy of a body encoded with the given Content-Encoding.
+// Unknown encodings are returned as-is.
+func decodeBody(buf []byte, encoding string) ([]byte, error) {
+	reader, err := bodyDecoder(buf, encoding)
+	if err != nil {
+		return nil, err
+	}
+	if reader == nil {
+		return buf, nil
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
+
+// bodyDecoder returns a reader decompressing a body encoded with the given Content-Encoding,
+// or nil if the encoding is unknown.
+func bodyDecoder(buf []byte, encoding string) (io.ReadCloser, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "gzip", "x-gzip":
+		reader, err := gzip.NewReader(bytes.NewReader(buf))
+		if err != nil {
+			return nil, fmt.Errorf("gzip: %w", err)
+		}
+		return reader, nil
+	case "deflate":
+		// "deflate" should be zlib-wrapped, but some servers send raw deflate data
+		if reader, err := zlib.NewReader(bytes.NewReader(buf)); err == nil {
+			return reader, nil
+		}
+		return flate.NewReader(bytes.NewReader(buf)), nil
+	default:
+		return nil, nil
+	}
+}
+
+// compactJSONBody removes the insignificant whitespace of a JSON body.
+// Non-JSON and invalid JSON bodies are returned unchanged.
+func compactJSONBody(body, contentType string) string {
+	if body == "" || !strings.Contains(strings.ToLower(contentType), "json") {
+		return body
+	}
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, []byte(body)); err != nil {
+		return body
+	}
+	return buf.String()
+}
+
+// encodeBinaryBody returns body encoded in base64 and "base64" if it contains invalid UTF-8 or NUL bytes,
+// which would not survive JSON marshaling, or else body unchanged and an empty encoding.
+func encodeBinaryBody(body string) (string, string) {
+	if utf8.ValidString(body) && !strings.ContainsRune(body, 0) {
+		return body, ""
+	}
+	return base64.StdEncoding.EncodeToString([]byte(body)), "base64"
+}
+
+// truncateBody returns the first max bytes of body, without splitting a UTF-8 character.
+func truncateBody(body string, max int) string {
+	if len(body) <= max {
+		return body
+	}
+	end := max
+	for end > 0 && !utf8.RuneStart(body[end]) {
+		end--
+	}
+	return body[:end]
+}
+
+// matchPaths returns true if urlPath matches one of the patterns.
+// Patterns containing "*", "?" or "[" are globs, as in path.Match,
+// others are prefixes matching whole segments.
+func matchPaths(patterns []string, urlPath string) bool {
+	for _, pattern := range patterns {
+		if strings.ContainsAny(pattern, "*?[") {
+			if matched, _ := path.Match(pattern, urlPath); matched {
+				return true
+			}
+			continue
+		}
+		prefix := strings.TrimSuffix(pattern, "/")
+		if urlPath == prefix || strings.HasPrefix(urlPath, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	id[6] = id[6]&0x0f | 0x40
+	id[8] = id[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:]), nil
+}
+
+// hashBody returns the SHA-256 digest of body, prefixed by "sha256:", or an empty string for an empty body.
+func hashBody(body string) string {
+	if body == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(body))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// latencyBucket returns the label of the bucket of latency, delimited by the ascending thresholds:
+// i.e., with thresholds of 100ms and 1s, "0s-100ms", "100ms-1s" or "1s+".
+func latencyBucket(latency time.Duration, thresholds []time.Duration) string {
+	lower := time.Duration(0)
+	for _, threshold := range thresholds {
+		if latency < threshold {
+			return lower.String() + "-" + threshold.String()
+		}
+		lower = threshold
+	}
+	return lower.String() + "+"
+}
+
+// deduplicateRecords collapses records sharing the same method, hostname, path and status code,
+// keeping the first one of each group with its Count set to the size of the group.
+func deduplicateRecords(records []ReportLog) []ReportLog {
+	type key struct {
+		method, hostname, path string
+		statusCode             int
+	}
+	indexes := map[key]int{}
+	ret := make([]ReportLog, 0, len(records))
+	for _, record := range records {
+		k := key{record.Method, record.Hostname, record.Path, record.StatusCode}
+		if idx, found := indexes[k]; found {
+			ret[idx].Count += countOrOne(record.Count)
+			continue
+		}
+		indexes[k] = len(ret)
+		record.Count = countOrOne(record.Count)
+		ret = append(ret, record)
+	}
+	return ret
+}
+
+func countOrOne(count int) int {
+	if count < 1 {
+		return 1
+	}
+	return count
+}
+
+// matchBlockedDomain returns the first entry of blockedDomains matching the URL's host.
+// Entries can be a hostname ("example.com", "::1", "[::1]") or include a port ("localhost:8080", "[::1]:8080"),
+// in which case only requests on that port are matched.
+func matchBlockedDomain(blockedDomains []string, u *url.URL) (string, bool) {
+	hostname := strings.ToLower(u.Hostname())
+	port := u.Port()
+	if port == "" {
+		switch strings.ToLower(u.Scheme) {
+		case "http":
+			port = "80"
+		case "https":
+			port = "443"
+		}
+	}
+	for _, entry := range blockedDomains {
+		entryHost, entryPort := splitHostPort(entry)
+		if entryHost != hostname {
+			continue
+		}
+		if entryPort != "" && entryPort != port {
+			continue
+		}
+		return entry, true
+	}
+	return "", false
+}
+
+// splitHostPort splits an optional port from a host, and normalizes IPv6 literals.
+func splitHostPort(input string) (string, string) {
+	input = strings.ToLower(strings.TrimSpace(input))
+	if host, port, err := net.SplitHostPort(input); err == nil {
+		return host, port
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(input, "["), "]"), ""
+}
+
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	default:
+		return fmt.Sprintf("0x%04X", version)
+	}
+}
@@ -0,0 +1,16 @@
+package bearer
+
+import (
+	"net/http"
+	"strings"
+)
+
+// isUpgrade returns true if the request is a protocol upgrade (i.e., a WebSocket handshake),
+// or if the server switched protocols. The body of such a response is the upgraded connection,
+// so it must never be read by the agent.
+func isUpgrade(req *http.Request, resp *http.Response) bool {
+	if resp != nil && resp.StatusCode == http.StatusSwitchingProtocols {
+		return true
+	}
+	return strings.EqualFold(req.Header.Get("Upgrade"), "websocket")
+}